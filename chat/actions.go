@@ -1,7 +1,20 @@
 package chat
 
 import (
+	"fmt"
+	"sort"
 	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const pageSize = 20
+
+const (
+	groupGeneral   = "General"
+	groupChannels  = "Channels"
+	groupMessaging = "Messaging"
+	groupAccount   = "Account"
 )
 
 var (
@@ -9,39 +22,294 @@ var (
 		{
 			Name:        "help",
 			Description: "Show help information",
-			Invoke:      showHelp,
+			Group:       groupGeneral,
+			Args:        []Arg{{Name: "action", Description: "Action to explain", Optional: true}},
+			Run:         showHelp,
 		},
 		{
 			Name:        "users",
 			Description: "List users in channel",
-			Invoke:      listUsers,
+			Group:       groupGeneral,
+			Args:        []Arg{{Name: "page", Type: ArgInt, Description: "Page to show", Optional: true}},
+			Run:         listUsers,
 		},
 		{
 			Name:        "channels",
 			Description: "List channels on server",
-			Invoke:      listChannels,
+			Group:       groupChannels,
+			Args:        []Arg{{Name: "page", Type: ArgInt, Description: "Page to show", Optional: true}},
+			Run:         listChannels,
+		},
+		{
+			Name:        "create",
+			Description: "Create a new channel and join it",
+			Group:       groupChannels,
+			Args:        []Arg{{Name: "name", Description: "Name of the new channel"}},
+			Run:         createChannel,
+			serial:      true,
+		},
+		{
+			Name:        "topic",
+			Description: "Show or change the topic of the current channel",
+			Group:       groupChannels,
+			Args:        []Arg{{Name: "topic", Type: ArgText, Description: "New topic", Optional: true}},
+			Run:         changeTopic,
+		},
+		{
+			Name:        "nick",
+			Description: "Change your name",
+			Group:       groupAccount,
+			Args:        []Arg{{Name: "name", Type: ArgText, Description: "New name", Optional: true}},
+			Run:         changeName,
+			serial:      true,
+		},
+		{
+			Name:        "msg",
+			Aliases:     []string{"tell"},
+			Description: "Send a private message to a user",
+			Group:       groupMessaging,
+			Args: []Arg{
+				{Name: "user", Type: ArgUser, Description: "Recipient"},
+				{Name: "text", Type: ArgText, Description: "Message to send"},
+			},
+			Run: directMessage,
+		},
+		{
+			Name:        "reply",
+			Aliases:     []string{"r"},
+			Description: "Reply to the last private message",
+			Group:       groupMessaging,
+			Args:        []Arg{{Name: "text", Type: ArgText, Description: "Message to send"}},
+			Run:         replyMessage,
+		},
+		{
+			Name:        "join",
+			Description: "Join a channel and make it current",
+			Group:       groupChannels,
+			Args:        []Arg{{Name: "channel", Type: ArgChannel, Description: "Channel to join"}},
+			Run:         joinChannel,
+			serial:      true,
+		},
+		{
+			Name:        "part",
+			Description: "Leave a channel, defaults to the current one",
+			Group:       groupChannels,
+			Args:        []Arg{{Name: "channel", Type: ArgChannel, Description: "Channel to leave", Optional: true}},
+			Run:         partChannel,
+			serial:      true,
+		},
+		{
+			Name:        "switch",
+			Description: "Send messages to another joined channel",
+			Group:       groupChannels,
+			Args:        []Arg{{Name: "channel", Type: ArgChannel, Description: "Joined channel to talk in"}},
+			Run:         switchChannel,
+			serial:      true,
 		},
 	}
 )
 
-func showHelp(host *Server, channel *Channel, user *User, command string) error {
-	actions := host.ListActions()
-	actionNames := make([]string, len(actions))
-	for i, a := range actions {
-		actionNames[i] = "!" + a.Name
+// showHelp lists the actions available to the user by group, or explains a single action.
+func showHelp(ctx *Context) error {
+	if ctx.Args.Has("action") {
+		name := ctx.Args.String("action")
+		if command, _, ok := ctx.Server.command(name); ok {
+			name = command
+		}
+		return explainAction(ctx, name)
+	}
+	prefix := ctx.Server.prefix()
+	groups := make(map[string][]string)
+	for _, a := range ctx.Server.ListActions() {
+		if !a.Hidden && ctx.User.Role() >= a.Role {
+			groups[a.Group] = append(groups[a.Group], prefix+a.Name)
+		}
+	}
+	names := make([]string, 0, len(groups))
+	for group, actions := range groups {
+		sort.Strings(actions)
+		if group != "" {
+			names = append(names, group)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := groups[""]; ok {
+		names = append(names, "")
+	}
+	for _, group := range names {
+		label := group
+		if label == "" {
+			label = "Other"
+		}
+		ctx.Reply("%s: %s.", label, strings.Join(groups[group], ", "))
+	}
+	return ctx.Reply("Use %shelp <action> to learn more about an action.", prefix)
+}
+
+// explainAction prints the generated usage of an action and its arguments.
+// Hidden actions and those above the role of the user are unknown to it.
+func explainAction(ctx *Context, name string) error {
+	action, ok := ctx.Server.Action(name)
+	if !ok || action.Hidden || ctx.User.Role() < action.Role {
+		return errors.New(ctx.Server.unknownAction(name, ctx.User.Role()))
+	}
+	prefix := ctx.Server.prefix()
+	ctx.Reply("Usage: %s", action.Usage(prefix))
+	if action.Description != "" {
+		ctx.Reply("%s.", action.Description)
 	}
-	message := "Available actions are " + strings.Join(actionNames, ", ") + "."
-	user.Send(Message{
+	if len(action.Aliases) > 0 {
+		ctx.Reply("Also known as %s%s.", prefix, strings.Join(action.Aliases, ", "+prefix))
+	}
+	for _, f := range action.Flags {
+		if f.Description != "" {
+			ctx.Reply("--%s: %s", f.Name, f.Description)
+		}
+	}
+	for _, arg := range action.Args {
+		if arg.Description != "" {
+			ctx.Reply("%s: %s", arg.Name, arg.Description)
+		}
+	}
+	return nil
+}
+
+func listUsers(ctx *Context) error {
+	members := ctx.Server.Roster()[ctx.Channel.Name]
+	page, pages, names := paginate(members, ctx.Args.Int("page"))
+	ctx.User.Send(Message{
 		Priority: PriorityLow,
-		Data:     message,
+		Channel:  ctx.Channel.Name,
+		Data:     fmt.Sprintf("Users in %s (%d, page %d/%d): %s.", ctx.Channel.Name, len(members), page, pages, strings.Join(names, ", ")),
 	})
 	return nil
 }
 
-func listUsers(host *Server, channel *Channel, user *User, command string) error {
+func listChannels(ctx *Context) error {
+	roster := ctx.Server.Roster()
+	channels := make([]string, 0, len(roster))
+	for name := range roster {
+		channels = append(channels, name)
+	}
+	sort.Strings(channels)
+	page, pages, channels := paginate(channels, ctx.Args.Int("page"))
+	for i, name := range channels {
+		channels[i] = fmt.Sprintf("%s (%d)", name, len(roster[name]))
+	}
+	ctx.User.Send(Message{
+		Priority: PriorityLow,
+		Data:     fmt.Sprintf("Channels (%d, page %d/%d): %s.", len(roster), page, pages, strings.Join(channels, ", ")),
+	})
 	return nil
 }
 
-func listChannels(host *Server, channel *Channel, user *User, command string) error {
-	return nil
+// paginate selects the requested page of items, defaulting to the first one.
+func paginate(items []string, page int) (int, int, []string) {
+	pages := (len(items) + pageSize - 1) / pageSize
+	if pages < 1 {
+		pages = 1
+	}
+	if page < 1 {
+		page = 1
+	} else if page > pages {
+		page = pages
+	}
+	start, end := (page-1)*pageSize, page*pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	return page, pages, items[start:end]
+}
+
+func joinChannel(ctx *Context) error {
+	target := ctx.Args.Channel("channel")
+	if !target.CanJoin(ctx.User) {
+		return forbid("You need to be a %s to join %s.", target.permissions.joinRole(), target.Name)
+	}
+	if err := ctx.User.Join(target); err != nil {
+		return err
+	}
+	return ctx.Reply("You are now talking in %s.", target.Name)
+}
+
+func createChannel(ctx *Context) error {
+	if policy := ctx.Server.channelPolicy; policy.AllowCreate && ctx.User.Role() < policy.CreateRole {
+		return forbid("You need to be a %s to create channels.", policy.CreateRole)
+	}
+	created, err := ctx.Server.CreateChannel(ctx.Args.String("name"), ctx.User.Name())
+	if err != nil {
+		return err
+	}
+	if err := ctx.User.Join(created); err != nil {
+		return err
+	}
+	return ctx.Reply("Created channel %s, you are now talking in it.", created.Name)
+}
+
+func changeTopic(ctx *Context) error {
+	text := ctx.Args.String("topic")
+	if text == "" {
+		if current := ctx.Channel.Topic(); current != "" {
+			return ctx.Reply("Topic of %s: %s", ctx.Channel.Name, current)
+		}
+		return ctx.Reply("%s has no topic.", ctx.Channel.Name)
+	}
+	return ctx.Channel.SetTopic(text, ctx.User)
+}
+
+func partChannel(ctx *Context) error {
+	target := ctx.Channel
+	if ctx.Args.Has("channel") {
+		member, ok := ctx.User.Member(ctx.Args.Channel("channel").Name)
+		if !ok {
+			return errors.Errorf("You are not a member of %q.", ctx.Args.Channel("channel").Name)
+		}
+		target = member
+	}
+	if err := ctx.User.Part(target); err != nil {
+		return errors.Errorf("You cannot leave %s, it is your last channel.", target.Name)
+	}
+	return ctx.Reply("You left %s and are now talking in %s.", target.Name, ctx.User.Current().Name)
+}
+
+func switchChannel(ctx *Context) error {
+	name := ctx.Args.Channel("channel").Name
+	target, ok := ctx.User.Member(name)
+	if !ok {
+		return errors.Errorf("You are not a member of %q, use %sjoin first.", name, ctx.Server.prefix())
+	}
+	ctx.User.Switch(target)
+	return ctx.Reply("You are now talking in %s.", target.Name)
+}
+
+func changeName(ctx *Context) error {
+	name := ctx.Args.String("name")
+	if name == "" {
+		return ctx.Reply("You are known as %s.", ctx.User.Name())
+	}
+	if err := ctx.Server.Rename(ctx.User, name); err != nil {
+		return err
+	}
+	return ctx.Reply("You are now known as %s.", name)
+}
+
+func directMessage(ctx *Context) error {
+	return ctx.Server.Direct(ctx.User, ctx.Args.String("user"), ctx.Args.String("text"))
+}
+
+func replyMessage(ctx *Context) error {
+	to := ctx.User.ReplyTo()
+	if to == "" {
+		return errors.New("Nobody has sent you a private message yet.")
+	}
+	return ctx.Server.Direct(ctx.User, to, ctx.Args.String("text"))
+}
+
+// notify sends a private low priority notice to the user.
+func notify(user *User, format string, args ...interface{}) error {
+	return user.Send(Message{
+		Sender:   user.host.Name,
+		Priority: PriorityLow,
+		Data:     fmt.Sprintf(format, args...),
+	})
 }
@@ -0,0 +1,281 @@
+package chat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// ArgType is the type of an action argument.
+type ArgType int
+
+const (
+	// ArgString is a single word, or several words in double quotes.
+	ArgString ArgType = iota
+	// ArgInt is a whole number.
+	ArgInt
+	// ArgBool is only valid for flags, which are switched on by being present.
+	ArgBool
+	// ArgUser is the name of an online user. Names with spaces need no quotes.
+	ArgUser
+	// ArgChannel is the name of an existing channel.
+	ArgChannel
+	// ArgText takes the rest of the line and must be the last argument.
+	ArgText
+)
+
+var argTypeNames = map[string]ArgType{
+	"string":  ArgString,
+	"int":     ArgInt,
+	"bool":    ArgBool,
+	"user":    ArgUser,
+	"channel": ArgChannel,
+	"text":    ArgText,
+}
+
+// ParseArgType reads an argument type from its name.
+func ParseArgType(name string) (ArgType, error) {
+	if name == "" {
+		return ArgString, nil
+	}
+	kind, ok := argTypeNames[strings.ToLower(name)]
+	if !ok {
+		return ArgString, errors.Errorf("unknown argument type %s", name)
+	}
+	return kind, nil
+}
+
+var argPlaceholders = map[ArgType]string{
+	ArgString:  "word",
+	ArgInt:     "number",
+	ArgUser:    "user",
+	ArgChannel: "channel",
+	ArgText:    "text",
+}
+
+// Arg declares a positional argument of an action.
+type Arg struct {
+	Name        string
+	Type        ArgType
+	Description string
+	Optional    bool
+}
+
+// Flag declares a named argument of an action, given as --name value or
+// --name=value. Bool flags take no value.
+type Flag struct {
+	Name        string
+	Type        ArgType
+	Description string
+	Default     string
+}
+
+// Values holds the parsed arguments of an invocation.
+type Values struct {
+	values map[string]interface{}
+}
+
+func (v Values) Has(name string) bool {
+	_, ok := v.values[name]
+	return ok
+}
+
+func (v Values) String(name string) string {
+	s, _ := v.values[name].(string)
+	return s
+}
+
+func (v Values) Int(name string) int {
+	i, _ := v.values[name].(int)
+	return i
+}
+
+func (v Values) Bool(name string) bool {
+	b, _ := v.values[name].(bool)
+	return b
+}
+
+func (v Values) Channel(name string) *Channel {
+	c, _ := v.values[name].(*Channel)
+	return c
+}
+
+// argError is a parse error, reported together with the usage of the action.
+type argError string
+
+func (e argError) Error() string {
+	return string(e)
+}
+
+// Usage returns the generated usage line of the action.
+func (a Action) Usage(prefix string) string {
+	parts := []string{prefix + a.Name}
+	for _, f := range a.Flags {
+		if f.Type == ArgBool {
+			parts = append(parts, "[--"+f.Name+"]")
+		} else {
+			parts = append(parts, fmt.Sprintf("[--%s <%s>]", f.Name, argPlaceholders[f.Type]))
+		}
+	}
+	for _, arg := range a.Args {
+		if arg.Optional {
+			parts = append(parts, "["+arg.Name+"]")
+		} else {
+			parts = append(parts, "<"+arg.Name+">")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// token is a word of the command line and the rest of the line after it.
+type token struct {
+	text, rest string
+}
+
+// tokenize splits a command line into words, keeping double quoted words together.
+func tokenize(line string) []token {
+	var tokens []token
+	line = strings.TrimLeftFunc(line, unicode.IsSpace)
+	for line != "" {
+		rest := line
+		var word string
+		if line[0] == '"' {
+			if end := strings.IndexByte(line[1:], '"'); end >= 0 {
+				word, line = line[1:end+1], line[end+2:]
+			}
+		}
+		if word == "" {
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			word, line = line[:end], line[end:]
+		}
+		tokens = append(tokens, token{text: word, rest: rest})
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+	}
+	return tokens
+}
+
+// parse checks the command line against the declared arguments. Actions
+// that declare nothing receive the command line as it is.
+func (a Action) parse(host *Server, line string) (Values, error) {
+	values := Values{values: map[string]interface{}{}}
+	if len(a.Args) == 0 && len(a.Flags) == 0 {
+		return values, nil
+	}
+	flags := map[string]Flag{}
+	for _, f := range a.Flags {
+		flags[f.Name] = f
+		if f.Default != "" {
+			v, err := convert(host, f.Name, f.Type, f.Default)
+			if err != nil {
+				return values, err
+			}
+			values.values[f.Name] = v
+		}
+	}
+	tokens := tokenize(line)
+	var positional []token
+	for i := 0; i < len(tokens); i++ {
+		word := tokens[i].text
+		if !strings.HasPrefix(word, "--") || len(word) < 3 || len(positional) > 0 {
+			positional = append(positional, tokens[i])
+			continue
+		}
+		name, value := word[2:], ""
+		hasValue := false
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+		f, ok := flags[name]
+		if !ok {
+			return values, argError(fmt.Sprintf("Unknown flag --%s.", name))
+		}
+		if f.Type == ArgBool && !hasValue {
+			values.values[name] = true
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(tokens) {
+				return values, argError(fmt.Sprintf("Flag --%s needs a value.", name))
+			}
+			i++
+			value = tokens[i].text
+		}
+		v, err := convert(host, name, f.Type, value)
+		if err != nil {
+			return values, err
+		}
+		values.values[name] = v
+	}
+	for _, arg := range a.Args {
+		if len(positional) == 0 {
+			if !arg.Optional {
+				return values, argError(fmt.Sprintf("Missing argument <%s>.", arg.Name))
+			}
+			continue
+		}
+		var raw string
+		switch arg.Type {
+		case ArgText:
+			raw, positional = strings.TrimSpace(positional[0].rest), nil
+		case ArgUser:
+			raw, positional = matchUser(host, positional)
+		default:
+			raw, positional = positional[0].text, positional[1:]
+		}
+		v, err := convert(host, arg.Name, arg.Type, raw)
+		if err != nil {
+			return values, err
+		}
+		values.values[arg.Name] = v
+	}
+	if len(positional) > 0 {
+		return values, argError(fmt.Sprintf("Unexpected argument %q.", positional[0].text))
+	}
+	return values, nil
+}
+
+// matchUser picks the longest online name at the start of the line, since
+// generated names contain spaces. It falls back to the first word.
+func matchUser(host *Server, tokens []token) (string, []token) {
+	line, match := tokens[0].rest, ""
+	for _, name := range host.Names() {
+		if len(name) > len(match) && strings.HasPrefix(line, name) &&
+			(len(line) == len(name) || unicode.IsSpace(rune(line[len(name)]))) {
+			match = name
+		}
+	}
+	if match == "" {
+		return tokens[0].text, tokens[1:]
+	}
+	return match, tokenize(line[len(match):])
+}
+
+func convert(host *Server, name string, kind ArgType, raw string) (interface{}, error) {
+	switch kind {
+	case ArgInt:
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, argError(fmt.Sprintf("Argument <%s> must be a number.", name))
+		}
+		return i, nil
+	case ArgBool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, argError(fmt.Sprintf("Flag --%s must be true or false.", name))
+		}
+		return b, nil
+	case ArgChannel:
+		channel, ok := host.Channel(raw)
+		if !ok {
+			return nil, argError(fmt.Sprintf("There is no channel named %q.", raw))
+		}
+		return channel, nil
+	}
+	return raw, nil
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoCredentials is returned by authenticators when a request does not
+// carry any credentials they understand.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Identity is the identity of a connection. Guest identities are not verified.
+type Identity struct {
+	Name  string
+	Roles []string
+	Guest bool
+}
+
+// Authenticator verifies the credentials of an incoming connection. It may
+// return ErrNoCredentials to let the next authenticator or guest access decide.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// reserver is implemented by authenticators that know their users up front,
+// so that guests cannot take their names.
+type reserver interface {
+	Reserves(name string) bool
+}
+
+type identityKey struct{}
+
+// authenticate asks every authenticator in turn. A nil identity means guest access.
+func (s *Server) authenticate(r *http.Request) (*Identity, error) {
+	for _, auth := range s.authenticators {
+		identity, err := auth.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return identity, nil
+	}
+	if !s.guests {
+		return nil, errors.New("authentication required")
+	}
+	return nil, nil
+}
+
+// reserved reports whether an authenticator reserves the name for one of its users.
+func (s *Server) reserved(name string) bool {
+	for _, auth := range s.authenticators {
+		if r, ok := auth.(reserver); ok && r.Reserves(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func withIdentity(r *http.Request, identity *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+func identityOf(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// WithAuthenticator adds an authenticator. Authenticators are asked in the
+// order they were added.
+func WithAuthenticator(auth Authenticator) Option {
+	return func(s *Server) {
+		s.authenticators = append(s.authenticators, auth)
+	}
+}
+
+// WithGuests controls whether connections without credentials are accepted.
+func WithGuests(allowed bool) Option {
+	return func(s *Server) {
+		s.guests = allowed
+	}
+}
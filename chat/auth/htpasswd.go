@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/lnsp/webchat/chat"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordAuthenticator checks HTTP basic credentials against a static
+// htpasswd-style file. Each line holds a name, a bcrypt hash and optionally a
+// comma separated list of roles, separated by colons.
+type PasswordAuthenticator struct {
+	accounts map[string]account
+}
+
+type account struct {
+	hash  []byte
+	roles []string
+}
+
+func LoadPasswords(file string) (*PasswordAuthenticator, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open password file")
+	}
+	defer f.Close()
+	return ReadPasswords(f)
+}
+
+func ReadPasswords(r io.Reader) (*PasswordAuthenticator, error) {
+	auth := &PasswordAuthenticator{accounts: map[string]account{}}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, errors.Errorf("malformed password entry on line %d", line)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, errors.Wrapf(err, "unsupported password hash on line %d", line)
+		}
+		acc := account{hash: []byte(fields[1])}
+		if len(fields) > 2 && fields[2] != "" {
+			acc.roles = strings.Split(fields[2], ",")
+		}
+		auth.accounts[fields[0]] = acc
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read password file")
+	}
+	return auth, nil
+}
+
+func (p *PasswordAuthenticator) Authenticate(r *http.Request) (*chat.Identity, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, chat.ErrNoCredentials
+	}
+	acc, ok := p.accounts[name]
+	if !ok {
+		return nil, errors.Errorf("unknown user %s", name)
+	}
+	if err := bcrypt.CompareHashAndPassword(acc.hash, []byte(password)); err != nil {
+		return nil, errors.Errorf("invalid password for %s", name)
+	}
+	return &chat.Identity{Name: name, Roles: acc.roles}, nil
+}
+
+// Reserves keeps guests from taking the names of registered users.
+func (p *PasswordAuthenticator) Reserves(name string) bool {
+	for n := range p.accounts {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package auth_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lnsp/webchat/chat"
+	"github.com/lnsp/webchat/chat/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func TestReadPasswords(t *testing.T) {
+	file := strings.Join([]string{
+		"# registered users",
+		"",
+		"alice:" + hash(t, "wonderland") + ":admin,moderator",
+		"bob:" + hash(t, "builder"),
+	}, "\n")
+	authenticator, err := auth.ReadPasswords(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, password string
+		roles          int
+		ok             bool
+	}{
+		{"alice", "wonderland", 2, true},
+		{"bob", "builder", 0, true},
+		{"alice", "builder", 0, false},
+		{"carol", "wonderland", 0, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(test.user, test.password)
+		identity, err := authenticator.Authenticate(r)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s:%s: expected an error", test.user, test.password)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.user, err)
+		} else if identity.Name != test.user || len(identity.Roles) != test.roles {
+			t.Errorf("%s: unexpected identity %+v", test.user, identity)
+		}
+	}
+	if _, err := authenticator.Authenticate(httptest.NewRequest("GET", "/", nil)); err != chat.ErrNoCredentials {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+	if !authenticator.Reserves("ALICE") || authenticator.Reserves("carol") {
+		t.Error("expected exactly the registered names to be reserved")
+	}
+}
+
+func TestReadPasswordsMalformed(t *testing.T) {
+	for _, file := range []string{
+		"alice",
+		":" + hash(t, "wonderland"),
+		"alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"alice:plain",
+	} {
+		if _, err := auth.ReadPasswords(strings.NewReader(file)); err == nil {
+			t.Errorf("expected %q to be rejected", file)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lnsp/webchat/chat"
+	"github.com/pkg/errors"
+)
+
+const bearerPrefix = "Bearer "
+
+// TokenAuthenticator verifies JWT bearer tokens signed with HS256. Tokens are
+// read from the Authorization header or the token query parameter, since
+// browsers cannot set headers on WebSocket connections.
+type TokenAuthenticator struct {
+	secret []byte
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Name      string   `json:"name"`
+	Roles     []string `json:"roles"`
+	Expires   int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+func NewTokenAuthenticator(secret []byte) *TokenAuthenticator {
+	return &TokenAuthenticator{secret: secret}
+}
+
+func (t *TokenAuthenticator) Authenticate(r *http.Request) (*chat.Identity, error) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, bearerPrefix) {
+		token = strings.TrimPrefix(header, bearerPrefix)
+	}
+	if token == "" {
+		return nil, chat.ErrNoCredentials
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "could not read token header")
+	}
+	if header.Algorithm != "HS256" {
+		return nil, errors.Errorf("unsupported token algorithm %s", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read token signature")
+	}
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "could not read token claims")
+	}
+	now := time.Now().Unix()
+	if claims.Expires != 0 && now >= claims.Expires {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+	name := claims.Name
+	if name == "" {
+		name = claims.Subject
+	}
+	if name == "" {
+		return nil, errors.New("token does not name a user")
+	}
+	return &chat.Identity{Name: name, Roles: claims.Roles}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, v)
+}
@@ -0,0 +1,81 @@
+package auth_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lnsp/webchat/chat"
+	"github.com/lnsp/webchat/chat/auth"
+)
+
+var secret = []byte("secret")
+
+// sign builds a token from raw header and claims, signed with HS256.
+func sign(key []byte, header, claims string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	hs256 := `{"alg":"HS256","typ":"JWT"}`
+	future, past := time.Now().Add(time.Hour).Unix(), time.Now().Add(-time.Hour).Unix()
+	tests := []struct {
+		name  string
+		token string
+		user  string
+	}{
+		{"valid", sign(secret, hs256, `{"name":"alice","roles":["admin"]}`), "alice"},
+		{"subject", sign(secret, hs256, `{"sub":"bob"}`), "bob"},
+		{"not expired", sign(secret, hs256, `{"name":"alice","exp":`+itoa(future)+`}`), "alice"},
+		{"expired", sign(secret, hs256, `{"name":"alice","exp":`+itoa(past)+`}`), ""},
+		{"not yet valid", sign(secret, hs256, `{"name":"alice","nbf":`+itoa(future)+`}`), ""},
+		{"bad signature", sign([]byte("other"), hs256, `{"name":"alice"}`), ""},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"name":"alice"}`)) + ".", ""},
+		{"alg confusion", sign(secret, `{"alg":"HS512"}`, `{"name":"alice"}`), ""},
+		{"no name", sign(secret, hs256, `{}`), ""},
+		{"malformed", "not.a-token", ""},
+	}
+	authenticator := auth.NewTokenAuthenticator(secret)
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/?token="+test.token, nil)
+		identity, err := authenticator.Authenticate(r)
+		if test.user == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, identity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if identity.Name != test.user || identity.Guest {
+			t.Errorf("%s: expected verified %s, got %+v", test.name, test.user, identity)
+		}
+	}
+}
+
+func TestTokenAuthenticatorHeader(t *testing.T) {
+	authenticator := auth.NewTokenAuthenticator(secret)
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, err := authenticator.Authenticate(r); err != chat.ErrNoCredentials {
+		t.Fatalf("expected no credentials, got %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+sign(secret, `{"alg":"HS256"}`, `{"name":"alice","roles":["moderator"]}`))
+	identity, err := authenticator.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identity.Roles) != 1 || identity.Roles[0] != "moderator" {
+		t.Errorf("expected role moderator, got %v", identity.Roles)
+	}
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
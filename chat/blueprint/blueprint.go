@@ -1,14 +1,15 @@
 package blueprint
 
 import (
+	"sync"
 	"time"
 
 	"github.com/lnsp/webchat/chat"
 )
 
-func PrivateResponse(senderName, channelName, data, media string) chat.Handler {
-	return func(server *chat.Server, channel *chat.Channel, user *chat.User, command string) error {
-		return user.Send(chat.Message{
+func PrivateResponse(senderName, channelName, data, media string) chat.ContextHandler {
+	return func(ctx *chat.Context) error {
+		return ctx.ReplyPrivately(chat.Message{
 			Sender:  senderName,
 			Data:    data,
 			Media:   media,
@@ -17,29 +18,55 @@ func PrivateResponse(senderName, channelName, data, media string) chat.Handler {
 	}
 }
 
-func BroadcastResponse(data, media string) chat.Handler {
-	return func(server *chat.Server, channel *chat.Channel, user *chat.User, command string) error {
-		channel.Publish(chat.Message{
-			Sender: user.Name,
-			Data:   data,
-			Media:  media,
+func BroadcastResponse(data, media string) chat.ContextHandler {
+	return func(ctx *chat.Context) error {
+		return ctx.Broadcast(chat.Message{
+			Data:  data,
+			Media: media,
 		})
-		return nil
 	}
 }
 
-func RateLimitMiddleware(invoke chat.Handler, interval time.Duration, message string) chat.Handler {
-	var timer time.Time
-	return func(server *chat.Server, channel *chat.Channel, user *chat.User, command string) error {
+// arguments collects the declared arguments of an invocation. Channels are
+// given by name and missing optional arguments are empty.
+func arguments(ctx *chat.Context) map[string]interface{} {
+	args := make(map[string]interface{}, len(ctx.Action.Args))
+	for _, arg := range ctx.Action.Args {
+		if !ctx.Args.Has(arg.Name) {
+			args[arg.Name] = ""
+			continue
+		}
+		switch arg.Type {
+		case chat.ArgInt:
+			args[arg.Name] = ctx.Args.Int(arg.Name)
+		case chat.ArgBool:
+			args[arg.Name] = ctx.Args.Bool(arg.Name)
+		case chat.ArgChannel:
+			args[arg.Name] = ctx.Args.Channel(arg.Name).Name
+		default:
+			args[arg.Name] = ctx.Args.String(arg.Name)
+		}
+	}
+	return args
+}
+
+func RateLimitMiddleware(invoke chat.ContextHandler, interval time.Duration, message string) chat.ContextHandler {
+	var (
+		mu    sync.Mutex
+		timer time.Time
+	)
+	return func(ctx *chat.Context) error {
+		mu.Lock()
 		if time.Since(timer) < interval {
-			user.Send(chat.Message{
+			mu.Unlock()
+			return ctx.ReplyPrivately(chat.Message{
 				Priority: chat.PriorityLow,
-				Channel:  channel.Name,
+				Channel:  ctx.Channel.Name,
 				Data:     message,
 			})
-			return nil
 		}
 		timer = time.Now()
-		return invoke(server, channel, user, command)
+		mu.Unlock()
+		return invoke(ctx)
 	}
 }
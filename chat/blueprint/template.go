@@ -0,0 +1,303 @@
+package blueprint
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lnsp/webchat/chat"
+	"github.com/pkg/errors"
+)
+
+// templateData is passed to response templates.
+type templateData struct {
+	User    string
+	Channel string
+	Server  string
+	Args    map[string]interface{}
+	Text    string
+	Time    time.Time
+}
+
+var templateFuncs = template.FuncMap{
+	"pick":  pick,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// pick returns one of its arguments at random.
+func pick(items ...interface{}) interface{} {
+	if len(items) == 0 {
+		return ""
+	}
+	return items[rand.Intn(len(items))]
+}
+
+// ParseTemplate parses a response template and checks the fields and
+// functions it refers to against the template data and the declared
+// arguments, so that mistakes show up before the action is used.
+func ParseTemplate(name, text string, args []chat.Arg) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse template")
+	}
+	declared := make(map[string]bool, len(args))
+	for _, arg := range args {
+		declared[arg.Name] = true
+	}
+	if err := (checker{args: declared}).walk(tmpl.Tree.Root, dataType); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+var dataType = reflect.TypeOf(templateData{})
+
+// checker follows the types a template is evaluated on. A nil type is not
+// known before the template runs, values of it are not checked.
+type checker struct {
+	args map[string]bool
+}
+
+func (c checker) walk(node parse.Node, dot reflect.Type) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := c.walk(child, dot); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		_, err := c.pipe(n.Pipe, dot)
+		return err
+	case *parse.TemplateNode:
+		_, err := c.pipe(n.Pipe, dot)
+		return err
+	case *parse.IfNode:
+		return c.branch(&n.BranchNode, dot, func(reflect.Type) reflect.Type { return dot })
+	case *parse.RangeNode:
+		return c.branch(&n.BranchNode, dot, element)
+	case *parse.WithNode:
+		return c.branch(&n.BranchNode, dot, func(typ reflect.Type) reflect.Type { return typ })
+	}
+	return nil
+}
+
+// branch checks the pipeline of a block, its body with the dot the block
+// sets and the else branch with the outer dot.
+func (c checker) branch(n *parse.BranchNode, dot reflect.Type, inner func(reflect.Type) reflect.Type) error {
+	typ, err := c.pipe(n.Pipe, dot)
+	if err != nil {
+		return err
+	}
+	if err := c.walk(n.List, inner(typ)); err != nil {
+		return err
+	}
+	return c.walk(n.ElseList, dot)
+}
+
+func (c checker) pipe(pipe *parse.PipeNode, dot reflect.Type) (reflect.Type, error) {
+	if pipe == nil {
+		return nil, nil
+	}
+	var typ reflect.Type
+	for i, cmd := range pipe.Cmds {
+		var err error
+		if typ, err = c.command(cmd, dot, typ, i > 0); err != nil {
+			return nil, err
+		}
+	}
+	return typ, nil
+}
+
+// command checks a command of a pipeline. Unless it is the first command,
+// the result of the previous one is passed as its last argument.
+func (c checker) command(cmd *parse.CommandNode, dot, previous reflect.Type, piped bool) (reflect.Type, error) {
+	args := cmd.Args[1:len(cmd.Args):len(cmd.Args)]
+	types := make([]reflect.Type, len(args))
+	for i, arg := range args {
+		var err error
+		if types[i], err = c.operand(arg, dot); err != nil {
+			return nil, err
+		}
+	}
+	if piped {
+		args, types = append(args, nil), append(types, previous)
+	}
+	if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
+		return c.function(ident.Ident, args, types)
+	}
+	return c.operand(cmd.Args[0], dot)
+}
+
+func (c checker) operand(node parse.Node, dot reflect.Type) (reflect.Type, error) {
+	switch n := node.(type) {
+	case *parse.DotNode:
+		return dot, nil
+	case *parse.FieldNode:
+		return c.field(dot, "", n.Ident)
+	case *parse.VariableNode:
+		// only the root is known, other variables are set while running
+		if n.Ident[0] != "$" {
+			return nil, nil
+		}
+		return c.field(dataType, "$", n.Ident[1:])
+	case *parse.ChainNode:
+		typ, err := c.operand(n.Node, dot)
+		if err != nil {
+			return nil, err
+		}
+		return c.field(typ, n.Node.String(), n.Field)
+	case *parse.PipeNode:
+		return c.pipe(n, dot)
+	case *parse.IdentifierNode:
+		return c.function(n.Ident, nil, nil)
+	case *parse.StringNode:
+		return reflect.TypeOf(""), nil
+	case *parse.BoolNode:
+		return reflect.TypeOf(true), nil
+	}
+	return nil, nil
+}
+
+// field resolves a chain of fields, map keys and methods. Keys of the
+// arguments need to be declared.
+func (c checker) field(typ reflect.Type, path string, idents []string) (reflect.Type, error) {
+	for i, ident := range idents {
+		if typ == nil || typ.Kind() == reflect.Interface {
+			return nil, nil
+		}
+		name := path + "." + ident
+		if method, ok := typ.MethodByName(ident); ok && method.Type.NumOut() > 0 {
+			typ, path = method.Type.Out(0), name
+			continue
+		}
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		switch typ.Kind() {
+		case reflect.Struct:
+			field, ok := typ.FieldByName(ident)
+			if !ok || field.PkgPath != "" {
+				return nil, errors.Errorf("unknown field %s", name)
+			}
+			if typ == dataType && ident == "Args" && i+1 < len(idents) && !c.args[idents[i+1]] {
+				return nil, errors.Errorf("unknown argument %s.%s", name, idents[i+1])
+			}
+			typ = field.Type
+		case reflect.Map:
+			typ = typ.Elem()
+		default:
+			return nil, errors.Errorf("unknown field %s", name)
+		}
+		path = name
+	}
+	return typ, nil
+}
+
+// function checks the number of arguments passed to a template function and
+// the types of those that are known. Built-in functions are left alone.
+func (c checker) function(name string, args []parse.Node, types []reflect.Type) (reflect.Type, error) {
+	fn, ok := templateFuncs[name]
+	if !ok {
+		return nil, nil
+	}
+	typ := reflect.TypeOf(fn)
+	in, variadic := typ.NumIn(), typ.IsVariadic()
+	if variadic && len(args) < in-1 {
+		return nil, errors.Errorf("wrong number of arguments for %s: want at least %d, got %d", name, in-1, len(args))
+	}
+	if !variadic && len(args) != in {
+		return nil, errors.Errorf("wrong number of arguments for %s: want %d, got %d", name, in, len(args))
+	}
+	for i, arg := range args {
+		var param reflect.Type
+		if variadic && i >= in-1 {
+			param = typ.In(in - 1).Elem()
+		} else {
+			param = typ.In(i)
+		}
+		if !accepts(param, arg, types[i]) {
+			var got interface{} = arg
+			if arg == nil {
+				got = types[i]
+			}
+			return nil, errors.Errorf("wrong type of argument for %s: want %s, got %v", name, param, got)
+		}
+	}
+	return typ.Out(0), nil
+}
+
+// accepts reports whether an argument may be passed as the parameter. The
+// argument is nil for the result of the previous command of a pipeline.
+func accepts(param reflect.Type, arg parse.Node, typ reflect.Type) bool {
+	if param.Kind() == reflect.Interface {
+		return true
+	}
+	if number, ok := arg.(*parse.NumberNode); ok {
+		switch param.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return number.IsInt
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return number.IsUint
+		case reflect.Float32, reflect.Float64:
+			return number.IsFloat
+		case reflect.Complex64, reflect.Complex128:
+			return number.IsComplex
+		}
+		return false
+	}
+	return typ == nil || typ.Kind() == reflect.Interface || typ.AssignableTo(param)
+}
+
+// element is the type range sets the dot to.
+func element(typ reflect.Type) reflect.Type {
+	if typ == nil {
+		return nil
+	}
+	switch typ.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.Chan:
+		return typ.Elem()
+	}
+	return nil
+}
+
+// TemplateResponse renders the template for every invocation and sends the
+// result to the invoking user or, if broadcast is set, to the channel.
+func TemplateResponse(tmpl *template.Template, sender, media string, broadcast bool) chat.ContextHandler {
+	return func(ctx *chat.Context) error {
+		data := templateData{
+			User:    ctx.User.Name(),
+			Channel: ctx.Channel.Name,
+			Server:  ctx.Server.Name,
+			Args:    arguments(ctx),
+			Text:    ctx.Command,
+			Time:    time.Now(),
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"action": ctx.Action.Name,
+				"err":    err,
+			}).Warn("Could not render template")
+			return errors.New("Could not render the response.")
+		}
+		msg := chat.Message{
+			Sender: sender,
+			Data:   out.String(),
+			Media:  media,
+		}
+		if broadcast {
+			return ctx.Broadcast(msg)
+		}
+		return ctx.ReplyPrivately(msg)
+	}
+}
@@ -0,0 +1,49 @@
+package blueprint_test
+
+import (
+	"testing"
+
+	"github.com/lnsp/webchat/chat"
+	"github.com/lnsp/webchat/chat/blueprint"
+)
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		text string
+		ok   bool
+	}{
+		{"Hello {{.User}} in {{.Channel}}", true},
+		{"{{.Args.target}} {{.Args.target.anything}}", true},
+		{"{{.Time.Format \"15:04\"}} {{.Time.Year}}", true},
+		{"{{upper .User}} {{.Text | lower}} {{pick \"a\" 1 .User}} {{pick}}", true},
+		{"{{$.User}} {{with .User}}{{.}}{{else}}{{$.Channel}}{{end}}", true},
+		{"{{range .Args}}{{.}}{{else}}{{.Text}}{{end}}", true},
+		{"{{if .Text}}{{.Text}}{{else}}{{.Server}}{{end}}", true},
+		{"{{$name := .User}}{{$name}} {{(.Time).Month}}", true},
+		{"{{.Nope}}", false},
+		{"{{.User.Foo}}", false},
+		{"{{$.Nope}}", false},
+		{"{{.Args.missing}}", false},
+		{"{{(.Time).Nope}}", false},
+		{"{{with .User}}{{.Foo}}{{end}}", false},
+		{"{{with .User}}{{else}}{{.Nope}}{{end}}", false},
+		{"{{range .Args}}{{else}}{{.Nope}}{{end}}", false},
+		{"{{if .Text}}{{else}}{{.Nope}}{{end}}", false},
+		{"{{upper}}", false},
+		{"{{upper 1}}", false},
+		{"{{upper .Time}}", false},
+		{"{{upper .User .Text}}", false},
+		{"{{.User | upper .Text}}", false},
+		{"{{.Time | lower}}", false},
+		{"{{printf \"%s\" upper}}", false},
+	}
+	args := []chat.Arg{{Name: "target"}}
+	for _, test := range tests {
+		_, err := blueprint.ParseTemplate("test", test.text, args)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.text, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.text)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package blueprint
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lnsp/webchat/chat"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the request body, if a secret is configured.
+	SignatureHeader       = "X-Webchat-Signature"
+	defaultWebhookTimeout = 5 * time.Second
+	maxWebhookResponse    = 1 << 20
+)
+
+var webhookClient = &http.Client{}
+
+// webhookRequest is the payload posted to a webhook.
+type webhookRequest struct {
+	Action  string                 `json:"action"`
+	User    string                 `json:"user"`
+	Role    string                 `json:"role"`
+	Channel string                 `json:"channel"`
+	Server  string                 `json:"server"`
+	Args    map[string]interface{} `json:"args"`
+	Text    string                 `json:"text"`
+	Time    int64                  `json:"time"`
+}
+
+// webhookResponse lists the messages to deliver. Messages are sent to the
+// invoking user unless they are marked for broadcast.
+type webhookResponse struct {
+	Messages []struct {
+		Data      string `json:"data"`
+		Media     string `json:"media"`
+		Priority  string `json:"priority"`
+		Broadcast bool   `json:"broadcast"`
+	} `json:"messages"`
+}
+
+// WebhookResponse posts every invocation to the URL and delivers the
+// messages of the response on behalf of sender, so that webhooks cannot
+// speak for other users. Requests are signed if secret is not empty.
+func WebhookResponse(url string, timeout time.Duration, secret []byte, sender string) chat.ContextHandler {
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return func(ctx *chat.Context) error {
+		body, err := json.Marshal(webhookRequest{
+			Action:  ctx.Action.Name,
+			User:    ctx.User.Name(),
+			Role:    ctx.User.Role().String(),
+			Channel: ctx.Channel.Name,
+			Server:  ctx.Server.Name,
+			Args:    arguments(ctx),
+			Text:    ctx.Command,
+			Time:    ctx.Message.Time,
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not encode webhook request")
+		}
+		response, err := callWebhook(ctx, url, timeout, secret, body)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"action": ctx.Action.Name,
+				"url":    url,
+				"err":    err,
+			}).Warn("Webhook failed")
+			return errors.Errorf("Could not reach the service behind %s, please try again later.", ctx.Action.Name)
+		}
+		for _, m := range response.Messages {
+			msg := chat.Message{
+				Sender:   sender,
+				Data:     m.Data,
+				Media:    m.Media,
+				Priority: m.Priority,
+			}
+			if m.Broadcast {
+				err = ctx.Broadcast(msg)
+			} else {
+				err = ctx.ReplyPrivately(msg)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func callWebhook(parent context.Context, url string, timeout time.Duration, secret, body []byte) (*webhookResponse, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not call webhook")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+		return nil, errors.Errorf("webhook answered with status %d", resp.StatusCode)
+	}
+	var response webhookResponse
+	if resp.StatusCode == http.StatusNoContent {
+		return &response, nil
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponse)).Decode(&response); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "could not decode webhook response")
+	}
+	for _, m := range response.Messages {
+		if m.Priority != "" && m.Priority != chat.PriorityHigh && m.Priority != chat.PriorityLow {
+			return nil, errors.Errorf("webhook answered with unknown priority %s", m.Priority)
+		}
+	}
+	return &response, nil
+}
@@ -0,0 +1,159 @@
+package blueprint_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lnsp/webchat/chat"
+	"github.com/lnsp/webchat/chat/blueprint"
+	"golang.org/x/net/websocket"
+)
+
+var secret = []byte("secret")
+
+// webhook answers with a private and two broadcast messages after checking the signature.
+func webhook(t *testing.T, priority string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if r.Header.Get(blueprint.SignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature %q", r.Header.Get(blueprint.SignatureHeader))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var invocation struct {
+			Action string `json:"action"`
+			Text   string `json:"text"`
+		}
+		if err := json.Unmarshal(body, &invocation); err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"messages": []map[string]interface{}{
+				{"data": "private " + invocation.Text},
+				{"data": "public " + invocation.Action, "priority": priority, "broadcast": true},
+				{"data": "again " + invocation.Action, "broadcast": true},
+			},
+		})
+	}))
+}
+
+type client struct {
+	ws     *websocket.Conn
+	frames chan chat.Frame
+}
+
+func dial(t *testing.T, url string) *client {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(url, "http"), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{chat.Subprotocol}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{ws: ws, frames: make(chan chat.Frame, 64)}
+	go func() {
+		defer close(c.frames)
+		for {
+			var frame chat.Frame
+			if err := websocket.JSON.Receive(ws, &frame); err != nil {
+				return
+			}
+			c.frames <- frame
+		}
+	}()
+	return c
+}
+
+// next returns the next frame matching the filter.
+func (c *client) next(t *testing.T, match func(chat.Frame) bool) chat.Frame {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				t.Fatal("connection closed")
+			}
+			if match(frame) {
+				return frame
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for frame")
+		}
+	}
+}
+
+func fromBot(frame chat.Frame) bool {
+	return frame.Message != nil && frame.Message.Sender == "Bot"
+}
+
+func TestWebhookResponse(t *testing.T) {
+	hook, invalid := webhook(t, chat.PriorityHigh), webhook(t, "urgent")
+	defer hook.Close()
+	defer invalid.Close()
+	s := chat.New(chat.WithChannels("main"), chat.WithMainChannel("main"), chat.WithTextLimit(140), chat.WithTextInterval(time.Second))
+	s.AddAction(chat.Action{Name: "hook", Run: blueprint.WebhookResponse(hook.URL, time.Second, secret, "Bot")})
+	s.AddAction(chat.Action{Name: "invalid", Run: blueprint.WebhookResponse(invalid.URL, time.Second, secret, "Bot")})
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	invoker, observer := dial(t, server.URL), dial(t, server.URL)
+	defer invoker.ws.Close()
+	defer observer.ws.Close()
+	observer.next(t, func(f chat.Frame) bool { return f.Type == chat.FrameHello })
+	if err := websocket.JSON.Send(invoker.ws, chat.Frame{Type: chat.FrameCommand, ID: "1", Name: "hook", Args: "a b"}); err != nil {
+		t.Fatal(err)
+	}
+	private := invoker.next(t, fromBot)
+	if private.Message.Data != "private a b" || private.Message.Channel != "" {
+		t.Errorf("expected the private message first, got %+v", private.Message)
+	}
+	// the broadcasts go through the broker and may arrive after the ack
+	acked := false
+	ack := func(f chat.Frame) bool { return f.Type == chat.FrameAck && f.ID == "1" }
+	public := invoker.next(t, func(f chat.Frame) bool {
+		acked = acked || ack(f)
+		return fromBot(f)
+	})
+	if public.Message.Data != "public hook" || public.Message.Priority != chat.PriorityHigh || public.Message.Channel != "main" {
+		t.Errorf("expected the broadcast, got %+v", public.Message)
+	}
+	// a single invocation may broadcast several messages within the message interval
+	again := invoker.next(t, func(f chat.Frame) bool {
+		acked = acked || ack(f)
+		return fromBot(f)
+	})
+	if again.Message.Data != "again hook" {
+		t.Errorf("expected the second broadcast, got %+v", again.Message)
+	}
+	if !acked {
+		invoker.next(t, ack)
+	}
+	for _, data := range []string{"public hook", "again hook"} {
+		if seen := observer.next(t, fromBot); seen.Message.Data != data {
+			t.Errorf("observer should only see the broadcasts, got %+v", seen.Message)
+		}
+	}
+
+	if err := websocket.JSON.Send(observer.ws, chat.Frame{Type: chat.FrameCommand, ID: "2", Name: "invalid"}); err != nil {
+		t.Fatal(err)
+	}
+	failed := observer.next(t, func(f chat.Frame) bool { return f.ID == "2" })
+	if failed.Type != chat.FrameError || failed.Error != chat.ErrorActionFailed {
+		t.Errorf("expected an unknown priority to fail the action, got %+v", failed)
+	}
+}
@@ -0,0 +1,46 @@
+package chat
+
+import (
+	"strings"
+)
+
+// Receiver is invoked by a Broker for each delivery matching a subscription.
+type Receiver func(key string, body []byte)
+
+// Broker relays published messages between server instances.
+// Deliveries must be handed to the receivers sequentially and in order.
+// Watch registers a callback that is notified when the broker loses or
+// regains its connection.
+type Broker interface {
+	Publish(key string, body []byte) error
+	Subscribe(key string, receive Receiver) error
+	Unsubscribe(key string) error
+	Watch(notify func(connected bool))
+	Close() error
+}
+
+// matchTopic reports whether the routing key matches the binding pattern.
+// Patterns use the AMQP topic syntax, where * matches exactly one word and #
+// matches zero or more words.
+func matchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+	}
+}
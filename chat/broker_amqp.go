@@ -0,0 +1,257 @@
+package chat
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+const (
+	exchangeName = "chat"
+	queuePrefix  = exchangeName + "."
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+var errBrokerDisconnected = errors.New("broker is disconnected")
+
+// AMQPBroker relays messages through a RabbitMQ topic exchange.
+// Each instance consumes from its own queue bound to the subscribed keys.
+// Lost connections are re-established with exponential backoff.
+type AMQPBroker struct {
+	url       string
+	queue     string
+	mu        sync.RWMutex
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	connected bool
+	closing   bool
+	subs      map[string]Receiver
+	watchers  []func(bool)
+}
+
+func (b *AMQPBroker) Publish(key string, body []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if !b.connected {
+		return errBrokerDisconnected
+	}
+	if err := b.channel.Publish(exchangeName, key, false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	}); err != nil {
+		return errors.Wrap(err, "could not publish message")
+	}
+	return nil
+}
+
+func (b *AMQPBroker) Subscribe(key string, receive Receiver) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[key] = receive
+	if !b.connected {
+		// binding is restored on reconnect
+		return nil
+	}
+	if err := b.channel.QueueBind(b.queue, key, exchangeName, false, nil); err != nil {
+		return errors.Wrap(err, "could not bind queue to exchange")
+	}
+	logrus.WithFields(logrus.Fields{
+		"queue": b.queue,
+		"key":   key,
+	}).Debug("Bound queue to routing key")
+	return nil
+}
+
+func (b *AMQPBroker) Unsubscribe(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, key)
+	if !b.connected {
+		return nil
+	}
+	if err := b.channel.QueueUnbind(b.queue, key, exchangeName, nil); err != nil {
+		return errors.Wrap(err, "could not unbind queue from exchange")
+	}
+	logrus.WithFields(logrus.Fields{
+		"queue": b.queue,
+		"key":   key,
+	}).Debug("Unbound queue from routing key")
+	return nil
+}
+
+func (b *AMQPBroker) Watch(notify func(connected bool)) {
+	b.mu.Lock()
+	b.watchers = append(b.watchers, notify)
+	b.mu.Unlock()
+}
+
+func (b *AMQPBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closing = true
+	b.connected = false
+	return b.conn.Close()
+}
+
+func (b *AMQPBroker) receiver(key string) Receiver {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for pattern, receive := range b.subs {
+		if matchTopic(pattern, key) {
+			return receive
+		}
+	}
+	return nil
+}
+
+func (b *AMQPBroker) setConnected(connected bool) {
+	b.mu.Lock()
+	b.connected = connected
+	watchers := make([]func(bool), len(b.watchers))
+	copy(watchers, b.watchers)
+	b.mu.Unlock()
+	for _, notify := range watchers {
+		notify(connected)
+	}
+}
+
+func (b *AMQPBroker) consumeLoop(incoming <-chan amqp.Delivery) {
+	for payload := range incoming {
+		receive := b.receiver(payload.RoutingKey)
+		if receive == nil {
+			logrus.WithFields(logrus.Fields{
+				"id":    payload.MessageId,
+				"key":   payload.RoutingKey,
+				"queue": b.queue,
+			}).Warn("No receiver for delivery")
+			continue
+		}
+		receive(payload.RoutingKey, payload.Body)
+	}
+	logrus.WithFields(logrus.Fields{
+		"queue": b.queue,
+	}).Debug("Stopped consuming from queue")
+}
+
+// watchLoop waits for the connection to close and reconnects with
+// exponential backoff until the broker is closed deliberately.
+func (b *AMQPBroker) watchLoop(closed chan *amqp.Error) {
+	for {
+		reason, ok := <-closed
+		b.mu.RLock()
+		closing := b.closing
+		b.mu.RUnlock()
+		if closing {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"err":      reason,
+			"graceful": !ok,
+		}).Warn("Lost connection to message broker")
+		b.setConnected(false)
+
+		delay := minReconnectDelay
+		for {
+			time.Sleep(delay)
+			next, err := b.connect()
+			if err == nil {
+				closed = next
+				break
+			}
+			logrus.WithFields(logrus.Fields{
+				"err":   err,
+				"delay": delay,
+			}).Warn("Could not reconnect to message broker")
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+		logrus.WithField("queue", b.queue).Info("Reconnected to message broker")
+		b.setConnected(true)
+	}
+}
+
+// connect dials the broker, declares the exchange and queue and restores
+// all bindings. It returns a channel that is notified once the connection closes.
+func (b *AMQPBroker) connect() (chan *amqp.Error, error) {
+	conn, err := amqp.Dial(b.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not dial broker")
+	}
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not open channel")
+	}
+	if err := channel.ExchangeDeclare(exchangeName, "topic", true, false, false, false, nil); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not declare exchange")
+	}
+	logrus.WithFields(logrus.Fields{
+		"exchange": exchangeName,
+	}).Info("Declared chat exchange")
+
+	if _, err := channel.QueueDeclare(b.queue, false, false, false, false, nil); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not declare queue")
+	}
+	logrus.WithFields(logrus.Fields{
+		"queue": b.queue,
+	}).Info("Declared public queue")
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key := range b.subs {
+		if err := channel.QueueBind(b.queue, key, exchangeName, false, nil); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "could not bind queue to exchange")
+		}
+	}
+	incoming, err := channel.Consume(b.queue, "", true, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not consume from queue")
+	}
+	b.conn, b.channel, b.connected = conn, channel, true
+	go b.consumeLoop(incoming)
+	return closed, nil
+}
+
+func queueName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		// generate random bytes instead
+		var randBytes [8]byte
+		rand.Read(randBytes[:])
+		host = hex.EncodeToString(randBytes[:])
+	}
+	return queuePrefix + host
+}
+
+func DialAMQP(url string) (*AMQPBroker, error) {
+	broker := &AMQPBroker{
+		url:   url,
+		queue: queueName(),
+		subs:  map[string]Receiver{},
+	}
+	closed, err := broker.connect()
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"broker": url,
+	}).Info("Connected to message queue")
+	go broker.watchLoop(closed)
+	return broker, nil
+}
@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const memoryQueueSize = 1024
+
+var errBrokerClosed = errors.New("broker is closed")
+
+type delivery struct {
+	key  string
+	body []byte
+}
+
+// MemoryBroker is an in-process Broker for single instances and tests.
+type MemoryBroker struct {
+	mu     sync.RWMutex
+	subs   map[string]Receiver
+	queue  chan delivery
+	done   chan struct{}
+	closed bool
+}
+
+func (m *MemoryBroker) Publish(key string, body []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return errBrokerClosed
+	}
+	select {
+	case m.queue <- delivery{key, body}:
+		return nil
+	default:
+		return errors.New("broker queue is full")
+	}
+}
+
+func (m *MemoryBroker) Subscribe(key string, receive Receiver) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("broker is closed")
+	}
+	m.subs[key] = receive
+	return nil
+}
+
+func (m *MemoryBroker) Unsubscribe(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subs, key)
+	return nil
+}
+
+// Watch is a no-op, the in-memory broker never loses its connection.
+func (m *MemoryBroker) Watch(notify func(connected bool)) {}
+
+func (m *MemoryBroker) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	return nil
+}
+
+func (m *MemoryBroker) receiver(key string) Receiver {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for pattern, receive := range m.subs {
+		if matchTopic(pattern, key) {
+			return receive
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBroker) dispatchLoop() {
+	for {
+		select {
+		case d := <-m.queue:
+			if receive := m.receiver(d.key); receive != nil {
+				receive(d.key, d.body)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	broker := &MemoryBroker{
+		subs:  map[string]Receiver{},
+		queue: make(chan delivery, memoryQueueSize),
+		done:  make(chan struct{}),
+	}
+	go broker.dispatchLoop()
+	return broker
+}
@@ -1,29 +1,70 @@
 package chat
 
 import (
+	"sync"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 )
 
 type Handler func(*Server, *Channel, *User, string) error
 
+// Action is a command users invoke with a prefix and its name or one of its aliases. Role is the role required to invoke it.
+// Actions declaring Args and Flags have them checked before they are invoked.
+// Run is preferred over Invoke, which is adapted to it.
 type Action struct {
 	Invoke            Handler
+	Run               ContextHandler
 	Name, Description string
+	Role              Role
+	Aliases           []string
+	Args              []Arg
+	Flags             []Flag
+	Group             string
+	Hidden            bool
+	// serial actions change the state of the user. They run on the read
+	// loop, so that the next frame is only read once they are done.
+	serial bool
 }
 
 func NewAction(name, description string, handler Handler) Action {
 	return Action{
-		handler, name, description,
+		Invoke:      handler,
+		Name:        name,
+		Description: description,
 	}
 }
 
 type Channel struct {
 	Name         string
+	Owner        string
 	host         *Server
+	dynamic      bool
+	closed       bool
+	created      int64
+	creator      string
+	emptySince   time.Time
+	done         chan struct{}
+	mu           sync.RWMutex
 	participants map[string]*User
+	topic        topic
+	welcome      string
+	permissions  Permissions
+	queue        chan Message
+	dropped      int32
+	publishMu    sync.Mutex
+	sequence     uint64
+}
+
+// Names returns the names of the channel members in the whole cluster, sorted by name.
+func (c *Channel) Names() []string {
+	return c.host.Roster()[c.Name]
 }
 
+// List returns the members connected to this instance.
 func (c *Channel) List() []*User {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	users := make([]*User, 0, len(c.participants))
 	for _, u := range c.participants {
 		users = append(users, u)
@@ -32,12 +73,20 @@ func (c *Channel) List() []*User {
 }
 
 func (c *Channel) Publish(msg Message) {
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+	c.sequence++
 	c.host.publish(Message{
+		ID:       randomID(16),
+		Time:     time.Now().UnixNano() / int64(time.Millisecond),
 		Channel:  c.Name,
 		Data:     msg.Data,
 		Sender:   msg.Sender,
 		Media:    msg.Media,
 		Priority: msg.Priority,
+		Origin:   c.host.instance,
+		Sequence: c.sequence,
+		Kind:     msg.Kind,
 	})
 }
 
@@ -47,43 +96,129 @@ func (c *Channel) broadcast(msg Message) {
 		"sender":  msg.Sender,
 		"message": msg.Data,
 	}).Debug("Broadcasting message to users")
-	for _, p := range c.participants {
-		p.Send(msg)
+	for _, p := range c.List() {
+		if c.CanRead(p) {
+			p.Send(msg)
+		}
 	}
 }
 
 func (c *Channel) Join(u *User) {
+	c.join(u, true)
+}
+
+// join adds a member. Members restored from a session are not announced.
+// It fails if the channel has been removed in the meantime.
+func (c *Channel) join(u *User, announce bool) bool {
+	c.mu.Lock()
+	if c.closed || u.gone() {
+		c.mu.Unlock()
+		return false
+	}
 	logrus.WithFields(logrus.Fields{
 		"channel": c.Name,
-		"user":    u.Name,
+		"user":    u.Name(),
 	}).Debug("User joined channel")
-	c.participants[u.Name] = u
+	if len(c.participants) == 0 {
+		c.host.subscribe(c.Name)
+	}
+	c.participants[u.Name()] = u
+	c.mu.Unlock()
+	c.host.announce(eventJoin, c.Name, u.Name())
+	if !announce {
+		return true
+	}
 	c.Publish(Message{
 		Sender:   c.host.Name,
-		Data:     u.Name + " joined the channel",
+		Data:     u.Name() + " joined the channel",
 		Channel:  c.Name,
 		Priority: PriorityLow,
 	})
+	c.greet(u)
+	return true
 }
 
 func (c *Channel) Leave(u *User) {
+	c.leave(u, true)
+}
+
+func (c *Channel) leave(u *User, announce bool) {
 	logrus.WithFields(logrus.Fields{
 		"channel": c.Name,
-		"user":    u.Name,
+		"user":    u.Name(),
 	}).Debug("User left channel")
-	delete(c.participants, u.Name)
+	c.mu.Lock()
+	delete(c.participants, u.Name())
+	if len(c.participants) == 0 {
+		c.host.unsubscribe(c.Name)
+	}
+	c.mu.Unlock()
+	c.host.announce(eventLeave, c.Name, u.Name())
+	if !announce {
+		return
+	}
 	c.Publish(Message{
 		Sender:   c.host.Name,
-		Data:     u.Name + " left the channel",
+		Data:     u.Name() + " left the channel",
 		Channel:  c.Name,
 		Priority: PriorityLow,
 	})
 }
 
-func NewChannel(name string, host *Server) *Channel {
-	return &Channel{
+// rename moves a member to its new name and tells the channel about it.
+func (c *Channel) rename(u *User, old, name string) {
+	c.mu.Lock()
+	if c.participants[old] == u {
+		delete(c.participants, old)
+	}
+	c.participants[name] = u
+	c.mu.Unlock()
+	c.host.announce(eventLeave, c.Name, old)
+	c.host.announce(eventJoin, c.Name, name)
+	c.Publish(Message{
+		Sender:   c.host.Name,
+		Data:     old + " is now known as " + name,
+		Channel:  c.Name,
+		Priority: PriorityLow,
+	})
+}
+
+// replace swaps a member for the connection that took over its session.
+func (c *Channel) replace(previous, u *User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.participants[u.Name()] == previous {
+		c.participants[u.Name()] = u
+	}
+}
+
+// retire marks an empty channel as closed, so that no one can join it anymore.
+func (c *Channel) retire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.participants) > 0 {
+		return false
+	}
+	c.closed = true
+	return true
+}
+
+// close stops the delivery loop of a removed channel.
+func (c *Channel) close() {
+	close(c.done)
+}
+
+func NewChannel(name string, host *Server, options ...ChannelOption) *Channel {
+	channel := &Channel{
 		Name:         name,
 		participants: map[string]*User{},
 		host:         host,
+		queue:        make(chan Message, deliveryQueueSize),
+		done:         make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt(channel)
 	}
+	go channel.deliveryLoop()
+	return channel
 }
@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"encoding/json"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	clusterPrefix  = "cluster."
+	instancePrefix = "instance."
+)
+
+// event is exchanged between instances on the cluster routing keys.
+type event struct {
+	Type     string              `json:"type"`
+	Origin   string              `json:"origin"`
+	Channel  string              `json:"channel,omitempty"`
+	Name     string              `json:"name,omitempty"`
+	Roster   map[string][]string `json:"roster,omitempty"`
+	Channels []string            `json:"channels,omitempty"`
+	Topics   map[string]topic    `json:"topics,omitempty"`
+	Message  *Message            `json:"message,omitempty"`
+	Time     int64               `json:"time,omitempty"`
+	Session  string              `json:"session,omitempty"`
+	Last     string              `json:"last,omitempty"`
+	Messages []Message           `json:"messages,omitempty"`
+	Complete bool                `json:"complete,omitempty"`
+	Verified bool                `json:"verified,omitempty"`
+}
+
+// instanceKey is the routing key for events addressed to a single instance.
+func instanceKey(instance string) string {
+	return instancePrefix + instance
+}
+
+func (s *Server) emit(key string, ev event) {
+	bytes, err := json.Marshal(ev)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"type": ev.Type,
+			"err":  err,
+		}).Warn("Could not marshal event")
+		return
+	}
+	s.send(key, bytes)
+}
+
+func (s *Server) receiveEvent(key string, body []byte) {
+	var ev event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"key": key,
+			"err": err,
+		}).Warn("Failed to consume event")
+		return
+	}
+	if ev.Origin == s.instance {
+		return
+	}
+	switch ev.Type {
+	case eventHeartbeat:
+		s.presence.update(s, ev)
+		s.receiveChannelEvent(ev)
+		s.receiveTopics(ev.Topics)
+	case eventTopic:
+		s.receiveTopics(ev.Topics)
+	case eventDirect, eventDirectFailed:
+		s.receiveDirect(ev)
+	case eventNameClaim, eventNameTaken:
+		s.receiveClaim(ev)
+	case eventSessionDetach, eventSessionResume:
+		s.receiveSession(ev)
+	case eventSessionReplay:
+		s.receiveReplay(ev)
+	case eventJoin, eventLeave:
+		s.presence.update(s, ev)
+	case eventChannelCreate, eventChannelRemove:
+		s.receiveChannelEvent(ev)
+	default:
+		logrus.WithFields(logrus.Fields{
+			"type":   ev.Type,
+			"origin": ev.Origin,
+		}).Debug("Ignoring unknown event")
+	}
+}
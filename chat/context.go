@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"context"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// DefaultActionTimeout is how long actions may run unless configured otherwise.
+const DefaultActionTimeout = 10 * time.Second
+
+const actionQueue = 8
+
+// ContextHandler handles an invocation of an action.
+type ContextHandler func(*Context) error
+
+// Context describes a single invocation of an action. It is cancelled when
+// the action times out or the user disconnects.
+type Context struct {
+	context.Context
+	Server  *Server
+	Channel *Channel
+	User    *User
+	Action  Action
+	// Args holds the arguments parsed according to the declaration of the
+	// action, Command the unparsed rest of the line.
+	Args    Values
+	Command string
+	// Message is the message the action was invoked with.
+	Message Message
+
+	id     string
+	mu     sync.Mutex
+	failed bool
+}
+
+// Adapt turns a plain handler into a context handler.
+func Adapt(handler Handler) ContextHandler {
+	return func(ctx *Context) error {
+		return handler(ctx.Server, ctx.Channel, ctx.User, ctx.Command)
+	}
+}
+
+// Reply sends a private notice to the invoking user.
+func (ctx *Context) Reply(format string, args ...interface{}) error {
+	return notify(ctx.User, format, args...)
+}
+
+// ReplyPrivately sends a message only the invoking user sees. The sender
+// defaults to the server.
+func (ctx *Context) ReplyPrivately(msg Message) error {
+	if msg.Sender == "" {
+		msg.Sender = ctx.Server.Name
+	}
+	return ctx.User.Send(msg)
+}
+
+// Broadcast publishes a message in the channel the action was invoked in.
+// The sender defaults to the invoking user, who needs to be allowed to write
+// in the channel. Text messages are held to the length limit of the server;
+// the message interval already applies to the invocation as a whole.
+func (ctx *Context) Broadcast(msg Message) error {
+	channel, user := ctx.Channel, ctx.User
+	if !channel.CanWrite(user) {
+		return forbid("You need to be a %s to write in %s.", channel.permissions.Write, channel.Name)
+	}
+	if length := utf8.RuneCountInString(msg.Data); msg.Media == "" && length > ctx.Server.textLimit {
+		return errors.Errorf("The message is %d characters long, the limit is %d characters.", length, ctx.Server.textLimit)
+	}
+	if msg.Sender == "" {
+		msg.Sender = ctx.User.Name()
+	}
+	ctx.Channel.Publish(msg)
+	return nil
+}
+
+// ReplyError fails the invocation with the given error. The action may keep
+// running, but the invocation is no longer acknowledged.
+func (ctx *Context) ReplyError(err error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.failed {
+		return
+	}
+	ctx.failed = true
+	code := ErrorActionFailed
+	if _, ok := err.(forbidden); ok {
+		code = ErrorForbidden
+	}
+	ctx.User.reject(ctx.id, code, err.Error())
+}
+
+// finish acknowledges the invocation unless it has already failed.
+func (ctx *Context) finish() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if !ctx.failed {
+		ctx.failed = true
+		ctx.User.ack(ctx.id)
+	}
+}
+
+type invocation struct {
+	ctx     *Context
+	cancel  context.CancelFunc
+	handler ContextHandler
+}
+
+// runActions invokes the queued actions of the user one after another, so
+// that slow actions never block reading from the connection.
+func (user *User) runActions() {
+	for inv := range user.actions {
+		user.run(inv)
+	}
+}
+
+// gone reports whether the connection of the user has been closed. Actions
+// still running then must not change the state of the user.
+func (user *User) gone() bool {
+	return user.ctx.Err() != nil
+}
+
+// run waits for an action until it returns or its context is done. The
+// slot of the action is only freed once its handler has returned, so that
+// handlers ignoring their context still count against the queue.
+func (user *User) run(inv invocation) {
+	defer inv.cancel()
+	ctx := inv.ctx
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			<-user.slots
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				result <- errors.Errorf("Action %s%s failed.", ctx.Server.prefix(), ctx.Action.Name)
+				logrus.WithFields(logrus.Fields{
+					"action": ctx.Action.Name,
+					"panic":  r,
+				}).Error("Action panicked")
+			}
+		}()
+		result <- inv.handler(ctx)
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = errors.Errorf("Action %s%s did not finish in time.", ctx.Server.prefix(), ctx.Action.Name)
+	}
+	if err == nil {
+		ctx.finish()
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"user":    user.Name(),
+		"channel": ctx.Channel.Name,
+		"action":  ctx.Action.Name,
+		"error":   err,
+	}).Warn("Failed to invoke action")
+	ctx.ReplyError(err)
+}
+
+// WithActionTimeout sets how long actions may run before they are cancelled.
+func WithActionTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.actionTimeout = timeout
+	}
+}
@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	eventDirect       = "direct.message"
+	eventDirectFailed = "direct.failed"
+)
+
+// User returns the user with the given name connected to this instance.
+func (s *Server) User(name string) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[name]
+	return user, ok
+}
+
+func (s *Server) register(user *User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Name()] = user
+}
+
+func (s *Server) unregister(user *User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users[user.Name()] == user {
+		delete(s.users, user.Name())
+	}
+}
+
+// locate returns the instance the named user is connected to.
+func (p *presence) locate(name string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for id, inst := range p.instances {
+		if time.Since(inst.seen) > presenceTTL {
+			continue
+		}
+		for _, names := range inst.roster {
+			if names[name] {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Direct delivers a private message from the user to the named recipient,
+// wherever the recipient is connected in the cluster.
+func (s *Server) Direct(from *User, to, text string) error {
+	msg := Message{
+		ID:     randomID(16),
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+		Sender: from.Name(),
+		To:     to,
+		Data:   text,
+		Origin: s.instance,
+	}
+	if recipient, ok := s.User(to); ok {
+		recipient.receiveDirect(msg)
+	} else if instance, ok := s.presence.locate(to); ok {
+		s.emit(instanceKey(instance), event{
+			Type:    eventDirect,
+			Origin:  s.instance,
+			Message: &msg,
+		})
+	} else {
+		return errors.Errorf("There is no user named %s online.", to)
+	}
+	from.Send(msg)
+	return nil
+}
+
+func (user *User) receiveDirect(msg Message) {
+	user.mu.Lock()
+	user.replyTo = msg.Sender
+	user.mu.Unlock()
+	user.Send(msg)
+}
+
+// ReplyTo returns the name of the user who sent the last direct message.
+func (user *User) ReplyTo() string {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.replyTo
+}
+
+func (s *Server) receiveDirect(ev event) {
+	msg := ev.Message
+	if msg == nil {
+		return
+	}
+	switch ev.Type {
+	case eventDirect:
+		if recipient, ok := s.User(msg.To); ok {
+			recipient.receiveDirect(*msg)
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"recipient": msg.To,
+			"origin":    ev.Origin,
+		}).Debug("Bouncing direct message for unknown user")
+		s.emit(instanceKey(ev.Origin), event{
+			Type:    eventDirectFailed,
+			Origin:  s.instance,
+			Message: msg,
+		})
+	case eventDirectFailed:
+		if sender, ok := s.User(msg.Sender); ok {
+			sender.Send(Message{
+				Sender:   s.Name,
+				Data:     msg.To + " went offline, your message was not delivered.",
+				Priority: PriorityLow,
+			})
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	channelsKey         = clusterPrefix + "channels"
+	eventChannelCreate  = "channel.create"
+	eventChannelRemove  = "channel.remove"
+	defaultMaxChannels  = 64
+	defaultChannelNames = `^[A-Za-z0-9_-]{1,32}$`
+)
+
+// ChannelPolicy controls the channels users create at runtime.
+// A zero TTL keeps empty user-created channels forever.
+type ChannelPolicy struct {
+	AllowCreate bool
+	CreateRole  Role
+	NamePattern *regexp.Regexp
+	MaxChannels int
+	TTL         time.Duration
+}
+
+var DefaultChannelPolicy = ChannelPolicy{
+	AllowCreate: true,
+	NamePattern: regexp.MustCompile(defaultChannelNames),
+	MaxChannels: defaultMaxChannels,
+}
+
+// tombstones remember recently removed channels, so that stale heartbeats
+// do not bring them back.
+type tombstones struct {
+	mu      sync.Mutex
+	removed map[string]time.Time
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{removed: map[string]time.Time{}}
+}
+
+func (t *tombstones) add(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removed[name] = time.Now()
+}
+
+func (t *tombstones) clear(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.removed, name)
+}
+
+func (t *tombstones) has(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed, ok := t.removed[name]
+	if ok && time.Since(removed) > presenceTTL {
+		delete(t.removed, name)
+		return false
+	}
+	return ok
+}
+
+// CreateChannel creates a channel on behalf of a user and replicates it to
+// all other instances.
+func (s *Server) CreateChannel(name, owner string) (*Channel, error) {
+	policy := s.channelPolicy
+	if !policy.AllowCreate {
+		return nil, errors.New("Creating channels is not allowed on this server.")
+	}
+	if policy.NamePattern != nil && !policy.NamePattern.MatchString(name) {
+		return nil, errors.Errorf("Channel names must match %s.", policy.NamePattern)
+	}
+	s.mu.Lock()
+	if _, ok := s.channels[name]; ok {
+		s.mu.Unlock()
+		return nil, errors.Errorf("Channel %s already exists.", name)
+	}
+	if policy.MaxChannels > 0 && len(s.channels) >= policy.MaxChannels {
+		s.mu.Unlock()
+		return nil, errors.Errorf("The server has reached its limit of %d channels.", policy.MaxChannels)
+	}
+	channel := NewChannel(name, s)
+	channel.Owner = owner
+	channel.dynamic = true
+	channel.created = time.Now().UnixNano()
+	channel.creator = s.instance
+	s.channels[name] = channel
+	s.mu.Unlock()
+	s.removed.clear(name)
+
+	logrus.WithFields(logrus.Fields{
+		"channel": name,
+		"owner":   owner,
+	}).Info("Created channel")
+	s.emit(channelsKey, event{
+		Type:    eventChannelCreate,
+		Origin:  s.instance,
+		Channel: name,
+		Name:    owner,
+		Time:    channel.created,
+	})
+	return channel, nil
+}
+
+// adopt adds a channel created on another instance. If several instances
+// created it at once, the earliest creation wins and the lowest instance
+// breaks ties, so that all instances agree on the owner. Heartbeats do not
+// know the creation and pass a zero time.
+func (s *Server) adopt(name, owner string, created int64, creator string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if channel, ok := s.channels[name]; ok {
+		if !channel.dynamic || created == 0 {
+			return
+		}
+		channel.mu.Lock()
+		if channel.created == 0 || created < channel.created || created == channel.created && creator < channel.creator {
+			channel.Owner, channel.created, channel.creator = owner, created, creator
+		}
+		channel.mu.Unlock()
+		return
+	}
+	channel := NewChannel(name, s)
+	channel.Owner = owner
+	channel.dynamic = true
+	channel.created = created
+	channel.creator = creator
+	s.channels[name] = channel
+	logrus.WithFields(logrus.Fields{
+		"channel": name,
+		"owner":   owner,
+	}).Debug("Adopted channel from cluster")
+}
+
+// removeChannel drops an empty user-created channel.
+func (s *Server) removeChannel(name string) bool {
+	s.mu.Lock()
+	channel, ok := s.channels[name]
+	if !ok || !channel.dynamic || !channel.retire() {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.channels, name)
+	s.mu.Unlock()
+	s.removed.add(name)
+	channel.close()
+	logrus.WithField("channel", name).Info("Removed empty channel")
+	return true
+}
+
+// dynamicChannels lists the names of all user-created channels.
+func (s *Server) dynamicChannels() []string {
+	var names []string
+	for _, c := range s.ListChannels() {
+		if c.dynamic {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// collectChannels removes user-created channels that have been empty in the
+// whole cluster for longer than the policy TTL.
+func (s *Server) collectChannels() {
+	if s.channelPolicy.TTL <= 0 {
+		return
+	}
+	roster := s.Roster()
+	for _, c := range s.ListChannels() {
+		if !c.dynamic {
+			continue
+		}
+		if len(roster[c.Name]) > 0 {
+			c.emptySince = time.Time{}
+			continue
+		}
+		if c.emptySince.IsZero() {
+			c.emptySince = time.Now()
+			continue
+		}
+		if time.Since(c.emptySince) > s.channelPolicy.TTL && s.removeChannel(c.Name) {
+			s.emit(channelsKey, event{
+				Type:    eventChannelRemove,
+				Origin:  s.instance,
+				Channel: c.Name,
+			})
+		}
+	}
+}
+
+func (s *Server) receiveChannelEvent(ev event) {
+	switch ev.Type {
+	case eventChannelCreate:
+		s.removed.clear(ev.Channel)
+		s.adopt(ev.Channel, ev.Name, ev.Time, ev.Origin)
+	case eventChannelRemove:
+		s.removeChannel(ev.Channel)
+	case eventHeartbeat:
+		for _, name := range ev.Channels {
+			if !s.removed.has(name) {
+				s.adopt(name, "", 0, "")
+			}
+		}
+	}
+}
+
+func WithChannelPolicy(policy ChannelPolicy) Option {
+	return func(s *Server) {
+		s.channelPolicy = policy
+	}
+}
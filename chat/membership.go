@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Current returns the channel outgoing text is published to.
+func (user *User) Current() *Channel {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.active
+}
+
+// Channels returns the channels the user is a member of, sorted by name.
+func (user *User) Channels() []*Channel {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	channels := make([]*Channel, 0, len(user.channels))
+	for _, c := range user.channels {
+		channels = append(channels, c)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels
+}
+
+// Member returns the joined channel with the given name.
+func (user *User) Member(name string) (*Channel, bool) {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	channel, ok := user.channels[name]
+	return channel, ok
+}
+
+// Join adds the user to the channel and makes it the current one.
+// It fails if the channel has been removed.
+func (user *User) Join(channel *Channel) error {
+	return user.join(channel, true)
+}
+
+func (user *User) join(channel *Channel, announce bool) error {
+	user.mu.Lock()
+	if user.gone() {
+		user.mu.Unlock()
+		return errors.New("You are no longer connected.")
+	}
+	_, member := user.channels[channel.Name]
+	previous := user.active
+	user.channels[channel.Name] = channel
+	user.active = channel
+	user.mu.Unlock()
+	if member || channel.join(user, announce) {
+		return nil
+	}
+	user.mu.Lock()
+	if user.channels[channel.Name] == channel {
+		delete(user.channels, channel.Name)
+	}
+	if user.active == channel {
+		user.active = previous
+	}
+	user.mu.Unlock()
+	return errors.Errorf("Channel %s no longer exists.", channel.Name)
+}
+
+// Part removes the user from the channel. The last channel cannot be left.
+func (user *User) Part(channel *Channel) error {
+	user.mu.Lock()
+	if _, ok := user.channels[channel.Name]; !ok {
+		user.mu.Unlock()
+		return errors.Errorf("not a member of %s", channel.Name)
+	}
+	if len(user.channels) < 2 {
+		user.mu.Unlock()
+		return errors.New("cannot leave the last channel")
+	}
+	delete(user.channels, channel.Name)
+	if user.active == channel {
+		user.active = nil
+		for _, c := range user.channels {
+			if user.active == nil || c.Name < user.active.Name {
+				user.active = c
+			}
+		}
+	}
+	user.mu.Unlock()
+	channel.Leave(user)
+	return nil
+}
+
+// Switch makes a joined channel the current one.
+func (user *User) Switch(channel *Channel) error {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if _, ok := user.channels[channel.Name]; !ok {
+		return errors.Errorf("not a member of %s", channel.Name)
+	}
+	user.active = channel
+	return nil
+}
+
+// partAll leaves every channel when the user disconnects.
+func (user *User) partAll(announce bool) {
+	user.mu.Lock()
+	channels := user.channels
+	user.channels = map[string]*Channel{}
+	user.active = nil
+	user.mu.Unlock()
+	for _, c := range channels {
+		c.leave(user, announce)
+	}
+}
+
+func (user *User) channelNames() []string {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	names := make([]string, 0, len(user.channels))
+	for name := range user.channels {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (user *User) currentName() string {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	if user.active == nil {
+		return ""
+	}
+	return user.active.Name
+}
+
+// takeOver moves the memberships of a previous connection to the user
+// without announcing it.
+func (user *User) takeOver(previous *User) {
+	previous.mu.Lock()
+	channels, active, replyTo := previous.channels, previous.active, previous.replyTo
+	previous.channels, previous.active = map[string]*Channel{}, nil
+	previous.mu.Unlock()
+	user.mu.Lock()
+	user.channels, user.active, user.replyTo = channels, active, replyTo
+	user.mu.Unlock()
+	for _, c := range channels {
+		c.replace(previous, user)
+	}
+}
@@ -0,0 +1,354 @@
+package chat
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/moby/moby/pkg/namesgenerator"
+	"github.com/pkg/errors"
+)
+
+const (
+	namesKey          = clusterPrefix + "names"
+	eventNameClaim    = "name.claim"
+	eventNameTaken    = "name.taken"
+	claimTimeout      = 500 * time.Millisecond
+	claimHold         = 10 * time.Second
+	maxNameRetries    = 8
+	defaultUserNames  = `^[A-Za-z0-9][A-Za-z0-9 _.-]*$`
+	defaultNameLength = 24
+)
+
+// NamePolicy controls the names users may pick with !nick. The server name
+// is always reserved. Reserved names are compared case-insensitively.
+type NamePolicy struct {
+	MinLength int
+	MaxLength int
+	Pattern   *regexp.Regexp
+	Reserved  []string
+}
+
+var DefaultNamePolicy = NamePolicy{
+	MinLength: 2,
+	MaxLength: defaultNameLength,
+	Pattern:   regexp.MustCompile(defaultUserNames),
+}
+
+// claims tracks the names this instance is currently trying to take.
+// A claim is given up when another instance reports the name as taken.
+type claims struct {
+	mu      sync.Mutex
+	pending map[string]*claim
+}
+
+type claim struct {
+	time   int64
+	denied chan struct{}
+}
+
+func newClaims() *claims {
+	return &claims{pending: map[string]*claim{}}
+}
+
+func (cl *claims) start(name string) (*claim, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	key := strings.ToLower(name)
+	if _, ok := cl.pending[key]; ok {
+		return nil, false
+	}
+	c := &claim{time: time.Now().UnixNano(), denied: make(chan struct{})}
+	cl.pending[key] = c
+	return c, true
+}
+
+func (cl *claims) get(name string) (*claim, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	c, ok := cl.pending[strings.ToLower(name)]
+	return c, ok
+}
+
+func (cl *claims) deny(name string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	key := strings.ToLower(name)
+	if c, ok := cl.pending[key]; ok {
+		close(c.denied)
+		delete(cl.pending, key)
+	}
+}
+
+func (cl *claims) finish(name string, c *claim) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	key := strings.ToLower(name)
+	if cl.pending[key] == c {
+		delete(cl.pending, key)
+	}
+}
+
+// Name returns the current name of the user.
+func (user *User) Name() string {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	return user.name
+}
+
+// Verified reports whether the name of the user was verified by an authenticator.
+func (user *User) Verified() bool {
+	return user.verified
+}
+
+// generateName picks a random name that is not in use anywhere in the cluster
+// and claims it. The claim is held for a while, so that no one else takes the
+// name before the connection is registered.
+func (s *Server) generateName() (string, error) {
+	for retry := 0; retry < maxNameRetries; retry++ {
+		name := strings.Join(Capitalize(strings.Split(namesgenerator.GetRandomName(retry), "_")...), " ")
+		if s.nameTaken(name, nil) {
+			continue
+		}
+		if c, ok := s.claimName(name, false); ok {
+			time.AfterFunc(claimHold, func() {
+				s.claims.finish(name, c)
+			})
+			return name, nil
+		}
+	}
+	return "", errors.New("Could not find a free name, please try again.")
+}
+
+// claimName asks the other instances whether they object to the name.
+// The caller finishes a successful claim once the name is in use. Claims of
+// verified names make other instances rename the guests holding them. Without
+// other live instances the claim succeeds right away.
+func (s *Server) claimName(name string, verified bool) (*claim, bool) {
+	c, ok := s.claims.start(name)
+	if !ok {
+		return nil, false
+	}
+	s.emit(namesKey, event{
+		Type:     eventNameClaim,
+		Origin:   s.instance,
+		Name:     name,
+		Time:     c.time,
+		Verified: verified,
+	})
+	if s.presence.peers() == 0 {
+		return c, true
+	}
+	select {
+	case <-c.denied:
+		return nil, false
+	case <-time.After(claimTimeout):
+		return c, true
+	}
+}
+
+// takeName claims the name of a verified identity. Guests holding the name
+// are renamed, verified users keep it.
+func (s *Server) takeName(name string) error {
+	if holder, ok := s.localUser(name); ok {
+		if holder.Verified() {
+			return errors.Errorf("%s is already connected", name)
+		}
+		s.evict(holder)
+	}
+	c, ok := s.claimName(name, true)
+	if !ok {
+		return errors.Errorf("%s is already connected", name)
+	}
+	time.AfterFunc(claimHold, func() {
+		s.claims.finish(name, c)
+	})
+	return nil
+}
+
+// evict gives a guest holding the name of a verified user a generated name.
+func (s *Server) evict(user *User) {
+	old := user.Name()
+	name, err := s.generateName()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"user": old,
+			"err":  err,
+		}).Warn("Could not rename guest, disconnecting")
+		user.stop()
+		return
+	}
+	s.rename(user, name, false)
+	notify(user, "%s has signed in, you are now known as %s.", old, name)
+}
+
+// localUser finds the local user holding the name.
+func (s *Server) localUser(name string) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if strings.EqualFold(u.Name(), name) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// localName reports whether a local user other than the given one holds the name.
+func (s *Server) localName(name string, except *User) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if u != except && strings.EqualFold(u.Name(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameTaken reports whether a user other than the given one holds the name
+// anywhere in the cluster.
+func (s *Server) nameTaken(name string, except *User) bool {
+	if s.localName(name, except) {
+		return true
+	}
+	if except != nil && strings.EqualFold(except.Name(), name) {
+		return false
+	}
+	for _, n := range s.Names() {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkName validates a name against the name policy. Names reserved by the
+// authenticators are left to Rename, since verified users carry them.
+func (s *Server) checkName(name string) error {
+	policy := s.namePolicy
+	length := utf8.RuneCountInString(name)
+	if policy.MaxLength <= 0 && length < policy.MinLength {
+		return errors.Errorf("Names must be at least %d characters long.", policy.MinLength)
+	}
+	if policy.MaxLength > 0 && (length < policy.MinLength || length > policy.MaxLength) {
+		return errors.Errorf("Names must be between %d and %d characters long.", policy.MinLength, policy.MaxLength)
+	}
+	if policy.Pattern != nil && !policy.Pattern.MatchString(name) {
+		return errors.Errorf("Names must match %s.", policy.Pattern)
+	}
+	for _, reserved := range append([]string{s.Name}, policy.Reserved...) {
+		if strings.EqualFold(reserved, name) {
+			return errors.Errorf("The name %s is reserved.", name)
+		}
+	}
+	return nil
+}
+
+// Rename changes the name of a local user after the other instances had a
+// chance to object to the claim.
+func (s *Server) Rename(user *User, name string) error {
+	name = strings.TrimSpace(name)
+	if user.Verified() {
+		return errors.New("Your name is verified and cannot be changed.")
+	}
+	if err := s.checkName(name); err != nil {
+		return err
+	}
+	if s.reserved(name) {
+		return errors.Errorf("The name %s is reserved.", name)
+	}
+	old := user.Name()
+	if old == name {
+		return errors.Errorf("You are already called %s.", name)
+	}
+	if s.nameTaken(name, user) {
+		return errors.Errorf("The name %s is already taken.", name)
+	}
+	c, ok := s.claimName(name, false)
+	if !ok {
+		return errors.Errorf("The name %s is already taken.", name)
+	}
+	defer s.claims.finish(name, c)
+	if !s.rename(user, name, true) {
+		return errors.New("You are no longer connected.")
+	}
+	return nil
+}
+
+// rename changes the name of a local user that has been claimed already.
+// Unless the user may be disconnected, it fails once the connection is gone.
+func (s *Server) rename(user *User, name string, connected bool) bool {
+	s.mu.Lock()
+	if connected && user.gone() {
+		s.mu.Unlock()
+		return false
+	}
+	old := user.name
+	if s.users[old] == user {
+		delete(s.users, old)
+	}
+	s.users[name] = user
+	user.mu.Lock()
+	user.name = name
+	channels := make([]*Channel, 0, len(user.channels))
+	for _, channel := range user.channels {
+		channels = append(channels, channel)
+	}
+	user.mu.Unlock()
+	s.mu.Unlock()
+
+	s.sessions.rename(user.session, name)
+	logrus.WithFields(logrus.Fields{
+		"old": old,
+		"new": name,
+	}).Info("Renamed user")
+	for _, channel := range channels {
+		channel.rename(user, old, name)
+	}
+	user.sendFrame(Frame{
+		Type:    FrameNick,
+		Name:    name,
+		Session: s.sessionToken(user.session, name),
+	})
+	return true
+}
+
+// receiveClaim objects to claims of names that are in use or that this
+// instance claimed first.
+func (s *Server) receiveClaim(ev event) {
+	switch ev.Type {
+	case eventNameClaim:
+		holder, taken := s.localUser(ev.Name)
+		if taken && ev.Verified && !holder.Verified() {
+			go s.evict(holder)
+			taken = false
+		}
+		if c, ok := s.claims.get(ev.Name); ok && (c.time < ev.Time || c.time == ev.Time && s.instance < ev.Origin) {
+			taken = true
+		}
+		if !taken {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"name":   ev.Name,
+			"origin": ev.Origin,
+		}).Debug("Rejecting name claim")
+		s.emit(instanceKey(ev.Origin), event{
+			Type:   eventNameTaken,
+			Origin: s.instance,
+			Name:   ev.Name,
+		})
+	case eventNameTaken:
+		s.claims.deny(ev.Name)
+	}
+}
+
+func WithNamePolicy(policy NamePolicy) Option {
+	return func(s *Server) {
+		s.namePolicy = policy
+	}
+}
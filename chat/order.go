@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	deliveryQueueSize = 256
+	reorderTimeout    = 500 * time.Millisecond
+	reorderLimit      = 64
+	droppedNotice     = "%d messages were dropped because %s could not keep up."
+)
+
+// origin tracks the delivery position of a single publishing instance in a channel.
+type origin struct {
+	next  uint64
+	last  time.Time
+	since time.Time
+	held  map[uint64]Message
+}
+
+// deliver queues a message received from the broker for in-order delivery.
+// It never blocks the broker: if the channel falls behind, the message is
+// dropped and the members are told about the gap.
+func (c *Channel) deliver(msg Message) {
+	select {
+	case c.queue <- msg:
+	case <-c.done:
+	default:
+		if atomic.AddInt32(&c.dropped, 1) == 1 {
+			logrus.WithField("channel", c.Name).Warn("Delivery queue is full, dropping messages")
+		}
+	}
+}
+
+// reportDropped tells the members how many messages were dropped since the last report.
+func (c *Channel) reportDropped() {
+	if dropped := atomic.SwapInt32(&c.dropped, 0); dropped > 0 {
+		c.broadcast(Message{
+			Sender:   c.host.Name,
+			Channel:  c.Name,
+			Data:     fmt.Sprintf(droppedNotice, dropped, c.Name),
+			Priority: PriorityLow,
+		})
+	}
+}
+
+// deliveryLoop serializes all broker deliveries of a channel. Messages are
+// put back into per-origin sequence order, holding early arrivals until the
+// gap is filled or reorderTimeout expires.
+func (c *Channel) deliveryLoop() {
+	ticker := time.NewTicker(reorderTimeout / 2)
+	defer ticker.Stop()
+	origins := map[string]*origin{}
+	for {
+		select {
+		case msg := <-c.queue:
+			c.reportDropped()
+			c.order(origins, msg)
+		case <-ticker.C:
+			c.reportDropped()
+			for name, o := range origins {
+				if len(o.held) > 0 && time.Since(o.since) > reorderTimeout {
+					c.skip(name, o)
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Channel) order(origins map[string]*origin, msg Message) {
+	if msg.Origin == "" {
+		c.broadcast(msg)
+		return
+	}
+	o, ok := origins[msg.Origin]
+	if !ok || (len(o.held) == 0 && time.Since(o.last) > reorderTimeout) {
+		// nothing in flight, resynchronize with this origin
+		o = &origin{next: msg.Sequence, held: map[uint64]Message{}}
+		origins[msg.Origin] = o
+	}
+	switch {
+	case msg.Sequence < o.next:
+		logrus.WithFields(logrus.Fields{
+			"channel":  c.Name,
+			"origin":   msg.Origin,
+			"sequence": msg.Sequence,
+		}).Debug("Dropping duplicate message")
+	case msg.Sequence > o.next:
+		if len(o.held) == 0 {
+			o.since = time.Now()
+		}
+		o.held[msg.Sequence] = msg
+		if len(o.held) > reorderLimit {
+			c.skip(msg.Origin, o)
+		}
+	default:
+		c.broadcast(msg)
+		o.next++
+		o.last = time.Now()
+		c.drain(o)
+	}
+}
+
+// skip gives up on the missing messages and continues with the oldest held one.
+func (c *Channel) skip(name string, o *origin) {
+	lowest := uint64(0)
+	for seq := range o.held {
+		if lowest == 0 || seq < lowest {
+			lowest = seq
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"channel": c.Name,
+		"origin":  name,
+		"missing": lowest - o.next,
+	}).Warn("Detected gap in message sequence")
+	o.next = lowest
+	c.drain(o)
+}
+
+func (c *Channel) drain(o *origin) {
+	for {
+		msg, ok := o.held[o.next]
+		if !ok {
+			o.since = time.Now()
+			return
+		}
+		delete(o.held, o.next)
+		c.broadcast(msg)
+		o.next++
+		o.last = time.Now()
+	}
+}
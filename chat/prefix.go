@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"strings"
+	"unicode"
+)
+
+const defaultPrefix = "!"
+
+// prefix returns the prefix shown in help and notices.
+func (s *Server) prefix() string {
+	return s.prefixes[0]
+}
+
+// command splits a line starting with one of the command prefixes into the
+// name of the action and its arguments. The longest matching prefix wins.
+func (s *Server) command(text string) (name, args string, ok bool) {
+	prefix := ""
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(text, p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	rest := text[len(prefix):]
+	if prefix == "" || rest == "" || unicode.IsSpace([]rune(rest)[0]) {
+		return "", "", false
+	}
+	fields := strings.SplitN(rest, " ", 2)
+	if len(fields) > 1 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return fields[0], args, true
+}
+
+// actionNames returns the names and aliases of the actions shown to the
+// role, leaving out hidden actions.
+func (s *Server) actionNames(role Role) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.actions)+len(s.aliases))
+	for name, action := range s.actions {
+		if !action.Hidden && role >= action.Role {
+			names = append(names, name)
+		}
+	}
+	for alias, name := range s.aliases {
+		if action := s.actions[name]; !action.Hidden && role >= action.Role {
+			names = append(names, alias)
+		}
+	}
+	return names
+}
+
+// WithPrefixes sets the prefixes that start a command. The first one is
+// used in help and notices.
+func WithPrefixes(prefixes ...string) Option {
+	return func(s *Server) {
+		if len(prefixes) > 0 {
+			s.prefixes = prefixes
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	presenceKey       = clusterPrefix + "presence"
+	heartbeatInterval = 5 * time.Second
+	presenceTTL       = 3 * heartbeatInterval
+	eventHeartbeat    = "presence.heartbeat"
+	eventJoin         = "presence.join"
+	eventLeave        = "presence.leave"
+)
+
+// presence keeps an eventually consistent roster of the users connected to
+// other instances. Instances that miss their heartbeats for presenceTTL are dropped.
+type presence struct {
+	mu        sync.RWMutex
+	instances map[string]*instance
+}
+
+type instance struct {
+	seen   time.Time
+	roster map[string]map[string]bool
+}
+
+func newPresence() *presence {
+	return &presence{instances: map[string]*instance{}}
+}
+
+func (p *presence) update(s *Server, ev event) {
+	p.mu.Lock()
+	inst, known := p.instances[ev.Origin]
+	if !known {
+		inst = &instance{roster: map[string]map[string]bool{}}
+		p.instances[ev.Origin] = inst
+	}
+	inst.seen = time.Now()
+	switch ev.Type {
+	case eventHeartbeat:
+		inst.roster = map[string]map[string]bool{}
+		for channel, names := range ev.Roster {
+			inst.roster[channel] = map[string]bool{}
+			for _, n := range names {
+				inst.roster[channel][n] = true
+			}
+		}
+	case eventJoin:
+		if inst.roster[ev.Channel] == nil {
+			inst.roster[ev.Channel] = map[string]bool{}
+		}
+		inst.roster[ev.Channel][ev.Name] = true
+	case eventLeave:
+		delete(inst.roster[ev.Channel], ev.Name)
+	}
+	p.mu.Unlock()
+	if !known {
+		// let the new instance learn about us without waiting for the next tick
+		s.heartbeat()
+	}
+}
+
+// merge adds the live remote members to the given roster.
+func (p *presence) merge(members map[string]map[string]bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, inst := range p.instances {
+		if time.Since(inst.seen) > presenceTTL {
+			continue
+		}
+		for channel, names := range inst.roster {
+			if members[channel] == nil {
+				members[channel] = map[string]bool{}
+			}
+			for n := range names {
+				members[channel][n] = true
+			}
+		}
+	}
+}
+
+// peers counts the other instances that are alive.
+func (p *presence) peers() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	count := 0
+	for _, inst := range p.instances {
+		if time.Since(inst.seen) <= presenceTTL {
+			count++
+		}
+	}
+	return count
+}
+
+func (p *presence) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, inst := range p.instances {
+		if time.Since(inst.seen) > presenceTTL {
+			delete(p.instances, id)
+		}
+	}
+}
+
+// localRoster lists the names of local users per channel.
+func (s *Server) localRoster() map[string][]string {
+	roster := map[string][]string{}
+	for _, c := range s.ListChannels() {
+		users := c.List()
+		names := make([]string, len(users))
+		for i, u := range users {
+			names[i] = u.Name()
+		}
+		roster[c.Name] = names
+	}
+	return roster
+}
+
+// Roster lists the users per channel across the whole cluster, sorted by name.
+func (s *Server) Roster() map[string][]string {
+	members := map[string]map[string]bool{}
+	for channel, names := range s.localRoster() {
+		members[channel] = map[string]bool{}
+		for _, n := range names {
+			members[channel][n] = true
+		}
+	}
+	s.presence.merge(members)
+	roster := make(map[string][]string, len(members))
+	for channel, names := range members {
+		sorted := make([]string, 0, len(names))
+		for n := range names {
+			sorted = append(sorted, n)
+		}
+		sort.Strings(sorted)
+		roster[channel] = sorted
+	}
+	return roster
+}
+
+func (s *Server) heartbeat() {
+	s.emit(presenceKey, event{
+		Type:     eventHeartbeat,
+		Origin:   s.instance,
+		Roster:   s.localRoster(),
+		Channels: s.dynamicChannels(),
+		Topics:   s.topics(),
+	})
+}
+
+func (s *Server) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.heartbeat()
+		s.presence.expire()
+		s.sessions.expire()
+		s.collectChannels()
+	}
+}
+
+// announce tells the other instances about a local join or leave.
+func (s *Server) announce(kind, channel, name string) {
+	s.emit(presenceKey, event{
+		Type:    kind,
+		Origin:  s.instance,
+		Channel: channel,
+		Name:    name,
+	})
+}
@@ -0,0 +1,185 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// ProtocolVersion is the version of the structured client protocol.
+// Clients select it by offering the Subprotocol during the handshake,
+// all other clients fall back to the legacy plain-text protocol.
+const (
+	ProtocolVersion = 1
+	Subprotocol     = "webchat.v1"
+)
+
+// Frame types exchanged with structured clients.
+const (
+	FrameHello   = "hello"
+	FrameMessage = "message"
+	FrameCommand = "command"
+	FrameDirect  = "direct"
+	FrameJoin    = "join"
+	FramePart    = "part"
+	FrameNick    = "nick"
+	FrameTyping  = "typing"
+	FramePing    = "ping"
+	FramePong    = "pong"
+	FrameAck     = "ack"
+	FrameError   = "error"
+)
+
+// Error codes carried by error frames.
+const (
+	ErrorBadFrame       = "bad_frame"
+	ErrorBadVersion     = "unsupported_version"
+	ErrorUnknownType    = "unknown_type"
+	ErrorUnknownCommand = "unknown_command"
+	ErrorUnsupported    = "unsupported"
+	ErrorRateLimited    = "rate_limited"
+	ErrorTooLong        = "too_long"
+	ErrorNotMember      = "not_member"
+	ErrorUnknownUser    = "unknown_user"
+	ErrorForbidden      = "forbidden"
+	ErrorBadArguments   = "bad_arguments"
+	ErrorActionFailed   = "action_failed"
+)
+
+// KindTyping marks messages that signal a typing user instead of carrying text.
+const KindTyping = "typing"
+
+// Frame is a single unit of the structured protocol in either direction.
+type Frame struct {
+	Version int    `json:"v,omitempty"`
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Args    string `json:"args,omitempty"`
+	Data    string `json:"data,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Session string `json:"session,omitempty"`
+	// Prefixes lists the command prefixes in the hello frame.
+	Prefixes []string `json:"prefixes,omitempty"`
+	Message  *Message `json:"message,omitempty"`
+}
+
+// low reports whether the frame may be dropped first under backpressure.
+func (f Frame) low() bool {
+	if f.Message != nil {
+		return f.Message.Priority == PriorityLow || f.Message.Kind == KindTyping
+	}
+	return f.Type != FrameError
+}
+
+// handshake selects the protocol offered by the client. Since the session
+// cookie identifies the user, it rejects null and cross-origin requests.
+func handshake(config *websocket.Config, req *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, req)
+	if err == nil && config.Origin == nil {
+		return errors.New("null origin")
+	}
+	if err != nil {
+		return err
+	}
+	if config.Origin.Host != req.Host {
+		return errors.Errorf("origin %s does not match host %s", config.Origin.Host, req.Host)
+	}
+	offered := config.Protocol
+	config.Protocol = nil
+	for _, p := range offered {
+		if p == Subprotocol {
+			config.Protocol = []string{Subprotocol}
+		}
+	}
+	return nil
+}
+
+// structured reports whether the connection negotiated the structured protocol.
+func structured(conn *websocket.Conn) bool {
+	protocols := conn.Config().Protocol
+	return len(protocols) == 1 && protocols[0] == Subprotocol
+}
+
+// receive reads the next frame from the client. Legacy plain-text input is
+// translated into message and command frames.
+func (user *User) receive() (Frame, error) {
+	var text string
+	if err := websocket.Message.Receive(user.conn, &text); err != nil {
+		return Frame{}, err
+	}
+	if !user.structured {
+		return user.legacyFrame(text), nil
+	}
+	var frame Frame
+	if err := json.Unmarshal([]byte(text), &frame); err != nil {
+		return Frame{}, decodeError{err}
+	}
+	return frame, nil
+}
+
+// decodeError signals a malformed frame on an otherwise healthy connection.
+type decodeError struct {
+	error
+}
+
+func (user *User) legacyFrame(text string) Frame {
+	text = strings.TrimSpace(text)
+	if name, args, ok := user.host.command(text); ok {
+		return Frame{
+			Type: FrameCommand,
+			Name: name,
+			Args: args,
+		}
+	}
+	return Frame{
+		Type: FrameMessage,
+		Data: text,
+	}
+}
+
+// encode converts an outbound frame to the wire format of the connection.
+// Legacy clients only understand chat messages, errors are turned into
+// private notices and all other frames are dropped.
+func (user *User) encode(frame Frame) (interface{}, bool) {
+	if user.structured {
+		frame.Version = ProtocolVersion
+		return frame, true
+	}
+	switch frame.Type {
+	case FrameMessage:
+		if frame.Message.Kind != "" {
+			return nil, false
+		}
+		return frame.Message, true
+	case FrameError:
+		return Message{
+			Sender:   user.host.Name,
+			Data:     frame.Data,
+			Priority: PriorityLow,
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+func (user *User) ack(id string) {
+	if id == "" {
+		return
+	}
+	user.sendFrame(Frame{Type: FrameAck, ID: id})
+}
+
+// reject reports a failed frame and the reason back to the client.
+func (user *User) reject(id, code, reason string) {
+	user.sendFrame(Frame{
+		Type:  FrameError,
+		ID:    id,
+		Error: code,
+		Data:  reason,
+	})
+}
@@ -0,0 +1,217 @@
+package chat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	lastParam              = "last"
+	eventSessionReplay     = "session.replay"
+	defaultReplaySize      = 100
+	defaultReplayRetention = 2 * time.Minute
+	replayTimeout          = time.Second
+	replayGapNotice        = "Some messages were sent while you were away and could not be replayed."
+)
+
+// replay keeps the most recent messages delivered to a session, so that a
+// client reconnecting with the ID of the last message it saw can catch up.
+type replay struct {
+	mu        sync.Mutex
+	size      int
+	retention time.Duration
+	messages  []replayed
+}
+
+// replayed is a buffered message, or a gap where the session had left its
+// channels and did not receive anything.
+type replayed struct {
+	msg Message
+	at  time.Time
+	gap bool
+}
+
+func newReplay(size int, retention time.Duration) *replay {
+	return &replay{size: size, retention: retention}
+}
+
+func (r *replay) add(msg Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, replayed{msg: msg, at: time.Now()})
+	r.trim()
+}
+
+// restore puts messages replayed from another instance ahead of the
+// messages buffered since, as they were delivered first.
+func (r *replay) restore(messages []Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	restored := make([]replayed, 0, len(messages)+len(r.messages))
+	for _, msg := range messages {
+		restored = append(restored, replayed{msg: msg, at: time.Now()})
+	}
+	r.messages = append(restored, r.messages...)
+	r.trim()
+}
+
+// leave marks that the session left its channels. Replays across the gap are incomplete.
+func (r *replay) leave() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, replayed{at: time.Now(), gap: true})
+	r.trim()
+}
+
+func (r *replay) trim() {
+	drop := 0
+	if len(r.messages) > r.size {
+		drop = len(r.messages) - r.size
+	}
+	for drop < len(r.messages) && time.Since(r.messages[drop].at) > r.retention {
+		drop++
+	}
+	if drop > 0 {
+		r.messages = append([]replayed(nil), r.messages[drop:]...)
+	}
+}
+
+// since returns the messages after the one with the given ID. If that
+// message is no longer buffered, all buffered messages are returned and
+// complete is false, as it is if the session left its channels since.
+func (r *replay) since(id string) (messages []Message, complete bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trim()
+	start := 0
+	for i, m := range r.messages {
+		if !m.gap && m.msg.ID == id {
+			start, complete = i+1, true
+		}
+	}
+	for _, m := range r.messages[start:] {
+		if m.gap {
+			complete = false
+			continue
+		}
+		messages = append(messages, m.msg)
+	}
+	return messages, complete
+}
+
+// record adds a message delivered to the user to its session buffer.
+func (user *User) record(msg Message) {
+	if user.buffer != nil && msg.ID != "" && msg.Kind == "" {
+		user.buffer.add(msg)
+	}
+}
+
+// pause holds back outgoing frames until the missed messages are replayed.
+func (user *User) pause() {
+	user.outMu.Lock()
+	defer user.outMu.Unlock()
+	user.paused = true
+}
+
+// resume queues the replayed messages ahead of the frames held back while
+// paused, skipping held messages that are part of the replay.
+func (user *User) resume(messages []Message, complete bool) {
+	user.outMu.Lock()
+	defer user.outMu.Unlock()
+	if !user.paused {
+		return
+	}
+	user.paused = false
+	replayed := make(map[string]bool, len(messages))
+	for i := range messages {
+		replayed[messages[i].ID] = true
+		user.out = append(user.out, Frame{Type: FrameMessage, Message: &messages[i]})
+	}
+	if !complete {
+		user.out = append(user.out, Frame{Type: FrameMessage, Message: &Message{
+			Sender:   user.host.Name,
+			Data:     replayGapNotice,
+			Priority: PriorityLow,
+		}})
+	}
+	for _, frame := range user.held {
+		if frame.Message != nil && replayed[frame.Message.ID] {
+			continue
+		}
+		user.out = append(user.out, frame)
+	}
+	user.held = nil
+	select {
+	case user.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replayTo asks the instance that held a detached session for the messages
+// the user missed, resuming live delivery if it does not answer in time.
+func (s *Server) replayTo(user *User, sess *session, last string) {
+	user.pause()
+	s.emit(sessionsKey, event{
+		Type:    eventSessionResume,
+		Origin:  s.instance,
+		Session: sess.id,
+		Last:    last,
+	})
+	time.AfterFunc(replayTimeout, func() {
+		user.resume(nil, true)
+	})
+}
+
+// sendReplay answers a resume request with the buffered messages of a
+// session, which may have left its channels already.
+func (s *Server) sendReplay(ev event, buffer *replay) {
+	if ev.Last == "" || buffer == nil {
+		return
+	}
+	messages, complete := buffer.since(ev.Last)
+	logrus.WithFields(logrus.Fields{
+		"session":  ev.Session,
+		"origin":   ev.Origin,
+		"messages": len(messages),
+	}).Debug("Replaying session to another instance")
+	s.emit(instanceKey(ev.Origin), event{
+		Type:     eventSessionReplay,
+		Origin:   s.instance,
+		Session:  ev.Session,
+		Messages: messages,
+		Complete: complete,
+	})
+}
+
+func (s *Server) receiveReplay(ev event) {
+	s.sessions.mu.Lock()
+	sess, ok := s.sessions.byID[ev.Session]
+	var user *User
+	if ok {
+		user = sess.user
+	}
+	s.sessions.mu.Unlock()
+	if user == nil {
+		return
+	}
+	if user.buffer != nil {
+		user.buffer.restore(ev.Messages)
+	}
+	user.resume(ev.Messages, ev.Complete)
+}
+
+// WithReplaySize sets how many messages are kept per session for replay.
+func WithReplaySize(size int) Option {
+	return func(s *Server) {
+		s.replaySize = size
+	}
+}
+
+// WithReplayRetention sets how long messages are kept for replay.
+func WithReplayRetention(retention time.Duration) Option {
+	return func(s *Server) {
+		s.replayRetention = retention
+	}
+}
@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Role ranks what a user may do. Each role includes the rights of the roles below it.
+type Role int
+
+const (
+	RoleGuest Role = iota
+	RoleMember
+	RoleModerator
+	RoleAdmin
+)
+
+var roleNames = []string{"guest", "member", "moderator", "admin"}
+
+func (r Role) String() string {
+	if r < RoleGuest || r > RoleAdmin {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole reads a role from its name.
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if strings.EqualFold(n, name) {
+			return Role(i), nil
+		}
+	}
+	return RoleGuest, errors.Errorf("unknown role %s", name)
+}
+
+// Permissions declare the roles needed to read, write and join a channel and
+// to change its topic.
+type Permissions struct {
+	Read  Role
+	Write Role
+	Join  Role
+	Topic Role
+}
+
+// forbidden reports a missing role back to the user.
+type forbidden string
+
+func (f forbidden) Error() string {
+	return string(f)
+}
+
+func forbid(format string, args ...interface{}) error {
+	return forbidden(fmt.Sprintf(format, args...))
+}
+
+// Role returns the role of the user.
+func (user *User) Role() Role {
+	return user.role
+}
+
+// role picks the highest role granted to a verified identity by the
+// authenticator or the server configuration. Verified users are at least members.
+func (s *Server) role(identity *Identity) Role {
+	if identity == nil || identity.Guest {
+		return RoleGuest
+	}
+	role := RoleMember
+	for _, name := range identity.Roles {
+		if r, err := ParseRole(name); err == nil && r > role {
+			role = r
+		}
+	}
+	if r, ok := s.roles[identity.Name]; ok && r > role {
+		role = r
+	}
+	return role
+}
+
+func (c *Channel) CanRead(user *User) bool {
+	return user.Role() >= c.permissions.Read
+}
+
+func (c *Channel) CanWrite(user *User) bool {
+	return user.Role() >= c.permissions.Write
+}
+
+// CanJoin reports whether the user may join. Joining requires reading.
+func (c *Channel) CanJoin(user *User) bool {
+	return user.Role() >= c.permissions.joinRole()
+}
+
+func (p Permissions) joinRole() Role {
+	if p.Read > p.Join {
+		return p.Read
+	}
+	return p.Join
+}
+
+func WithPermissions(permissions Permissions) ChannelOption {
+	return func(c *Channel) {
+		c.permissions = permissions
+	}
+}
+
+// WithRoles assigns roles to verified users by name.
+func WithRoles(roles map[string]Role) Option {
+	return func(s *Server) {
+		s.roles = roles
+	}
+}
@@ -1,16 +1,18 @@
 package chat
 
 import (
+	crand "crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"math/rand"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
-	"github.com/streadway/amqp"
 	"golang.org/x/net/websocket"
 )
 
@@ -20,27 +22,69 @@ const (
 	defaultMOTD         = "Welcome to WebChat!"
 	defaultTextInterval = 10 * time.Millisecond
 	defaultTextLimit    = 140
+	defaultOutboxSize   = 256
+	outboxRetry         = 100 * time.Millisecond
 )
 
 const (
-	exchangeName  = "chat"
-	queuePrefix   = exchangeName + "."
-	queueWildcard = queuePrefix + "*"
+	degradedNotice = "Lost connection to the chat network, messages are delayed until it is restored."
+	restoredNotice = "Connection to the chat network restored."
 )
 
+const messagePrefix = "chat."
+
+var routingKeyEscaper = strings.NewReplacer("%", "%25", ".", "%2E", "*", "%2A", "#", "%23")
+
+// routingKey derives the broker routing key used for messages in a channel.
+func routingKey(channel string) string {
+	return messagePrefix + routingKeyEscaper.Replace(channel)
+}
+
 type Server struct {
 	Name               string
+	instance           string
 	motd               string
-	channels           map[string]*Channel
 	textInterval       time.Duration
 	textLimit          int
+	sendQueue          int
+	backpressure       Backpressure
+	broker             Broker
+	mu                 sync.RWMutex
+	channels           map[string]*Channel
+	users              map[string]*User
 	actions            map[string]Action
-	broker             *amqp.Connection
+	aliases            map[string]string
+	prefixes           []string
 	defaultUserChannel string
-	activeChannel      *amqp.Channel
+	outboxMu           sync.Mutex
+	outbox             []pending
+	outboxSize         int
+	retrying           bool
+	degraded           bool
+	presence           *presence
+	channelPolicy      ChannelPolicy
+	namePolicy         NamePolicy
+	claims             *claims
+	authenticators     []Authenticator
+	guests             bool
+	sessions           *sessions
+	roles              map[string]Role
+	sessionSecret      []byte
+	gracePeriod        time.Duration
+	replaySize         int
+	replayRetention    time.Duration
+	actionTimeout      time.Duration
+	removed            *tombstones
+}
+
+type pending struct {
+	key  string
+	body []byte
 }
 
 func (s *Server) ListActions() []Action {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	actions := make([]Action, 0, len(s.actions))
 	for _, a := range s.actions {
 		actions = append(actions, a)
@@ -48,9 +92,10 @@ func (s *Server) ListActions() []Action {
 	return actions
 }
 
+// List returns the users in the channels of this instance.
 func (s *Server) List() []*User {
 	users := make(map[*User]bool)
-	for _, c := range s.channels {
+	for _, c := range s.ListChannels() {
 		for _, u := range c.List() {
 			users[u] = true
 		}
@@ -62,7 +107,25 @@ func (s *Server) List() []*User {
 	return endUsers
 }
 
+// Names returns the names of all users in the cluster, sorted by name.
+func (s *Server) Names() []string {
+	users := make(map[string]bool)
+	for _, names := range s.Roster() {
+		for _, n := range names {
+			users[n] = true
+		}
+	}
+	endUsers := make([]string, 0, len(users))
+	for u := range users {
+		endUsers = append(endUsers, u)
+	}
+	sort.Strings(endUsers)
+	return endUsers
+}
+
 func (s *Server) ListChannels() []*Channel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	channels := make([]*Channel, 0, len(s.channels))
 	for _, c := range s.channels {
 		channels = append(channels, c)
@@ -71,15 +134,62 @@ func (s *Server) ListChannels() []*Channel {
 }
 
 func (s *Server) AddChannel(channel *Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.channels[channel.Name] = channel
 }
 
+func (s *Server) Channel(name string) (*Channel, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	channel, ok := s.channels[name]
+	return channel, ok
+}
+
+// Action looks up an action by its name or one of its aliases.
+func (s *Server) Action(name string) (Action, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	action, ok := s.actions[name]
+	if !ok {
+		action, ok = s.actions[s.aliases[name]]
+	}
+	return action, ok
+}
+
+// mainChannel returns the channel new users join, creating it if it does
+// not exist yet. It is the default channel unless one has been configured.
+func (s *Server) mainChannel() *Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.defaultUserChannel == "" {
+		s.defaultUserChannel = defaultChannelName
+	}
+	channel, ok := s.channels[s.defaultUserChannel]
+	if !ok {
+		channel = NewChannel(s.defaultUserChannel, s)
+		s.channels[s.defaultUserChannel] = channel
+	}
+	return channel
+}
+
 func (s *Server) AddAction(action Action) {
 	logrus.WithFields(logrus.Fields{
 		"name":        action.Name,
 		"description": action.Description,
+		"aliases":     action.Aliases,
 	}).Debug("Add action to server")
-	s.actions["!"+action.Name] = action
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actions[action.Name] = action
+	for alias, name := range s.aliases {
+		if name == action.Name {
+			delete(s.aliases, alias)
+		}
+	}
+	for _, alias := range action.Aliases {
+		s.aliases[alias] = action.Name
+	}
 }
 
 func (s *Server) Accept(conn *websocket.Conn) {
@@ -88,30 +198,122 @@ func (s *Server) Accept(conn *websocket.Conn) {
 		"local":  conn.LocalAddr(),
 	}).Debug("Connected with client")
 
-	user := NewUser(conn, s)
+	identity, sess := identityOf(conn.Request()), sessionOf(conn.Request())
+	if identity == nil && sess != nil {
+		identity = &Identity{Name: s.sessions.nameOf(sess), Guest: true}
+	}
+	user, err := NewUser(conn, s, identity)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"remote": conn.RemoteAddr(),
+			"err":    err,
+		}).Warn("Could not accept connection")
+		conn.Close()
+		return
+	}
 	defer user.Watch()
 	logrus.WithFields(logrus.Fields{
-		"user": user.Name,
+		"user":     user.Name(),
+		"verified": user.Verified(),
 	}).Debug("Generated new user")
 
+	hello := Frame{
+		Type:     FrameHello,
+		Name:     user.Name(),
+		Prefixes: s.prefixes,
+	}
+	if sess != nil {
+		hello.Session = s.sessionToken(sess.id, user.Name())
+	}
+	user.sendFrame(hello)
 	user.Send(Message{
 		Sender: s.Name,
 		Data:   s.motd,
 	})
-	if len(s.channels) < 1 {
-		s.AddChannel(NewChannel(defaultChannelName, s))
-		s.defaultUserChannel = defaultChannelName
+	s.outboxMu.Lock()
+	degraded := s.degraded
+	s.outboxMu.Unlock()
+	if degraded {
+		user.Send(Message{
+			Sender:   s.Name,
+			Data:     degradedNotice,
+			Priority: PriorityLow,
+		})
+	}
+	if sess == nil {
+		s.register(user)
+	} else if s.attach(sess, user, conn.Request().URL.Query().Get(lastParam)) {
+		if current := user.Current(); current != nil {
+			notify(user, "Welcome back, you are talking in %s.", current.Name)
+			return
+		}
+	}
+	channel := s.entryChannel(user.Role())
+	if channel == nil || user.Join(channel) != nil {
+		logrus.WithField("user", user.Name()).Warn("No channel the user may join")
+		conn.Close()
+	}
+}
+
+// entryChannel picks the main channel, or the first channel by name that the
+// role may join if it is not enough for the main channel.
+func (s *Server) entryChannel(role Role) *Channel {
+	if main := s.mainChannel(); main != nil && role >= main.permissions.joinRole() {
+		return main
+	}
+	var entry *Channel
+	for _, c := range s.ListChannels() {
+		if !c.dynamic && role >= c.permissions.joinRole() && (entry == nil || c.Name < entry.Name) {
+			entry = c
+		}
 	}
-	main := s.channels[s.defaultUserChannel]
-	user.active = main
-	main.Join(user)
+	return entry
 }
 
 func (s *Server) Handler() http.Handler {
 	if s.broker == nil {
-		logrus.Fatal("Not connected to message queue")
+		if err := s.Connect(NewMemoryBroker()); err != nil {
+			logrus.WithField("err", err).Fatal("Could not connect to in-memory broker")
+		}
+		logrus.Warn("Not connected to message broker, using in-memory broker")
 	}
-	return websocket.Handler(s.Accept)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := s.authenticate(r)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"remote": r.RemoteAddr,
+				"err":    err,
+			}).Info("Rejected connection")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// verified names are held to the name policy as well, but they are
+		// the ones the authenticator reserves
+		if identity != nil {
+			if err := s.checkName(identity.Name); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		if s.entryChannel(s.role(identity)) == nil {
+			http.Error(w, "There is no channel you are allowed to join.", http.StatusForbidden)
+			return
+		}
+		sess, err := s.session(r, identity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		header := s.sessionHeader(r, s.sessionToken(sess.id, s.sessions.nameOf(sess)))
+		ws := websocket.Server{
+			Handshake: func(config *websocket.Config, req *http.Request) error {
+				config.Header = header
+				return handshake(config, req)
+			},
+			Handler: s.Accept,
+		}
+		ws.ServeHTTP(w, withSession(withIdentity(r, identity), sess))
+	})
 }
 
 func (s *Server) publish(msg Message) {
@@ -123,19 +325,107 @@ func (s *Server) publish(msg Message) {
 		}).Warn("Could not marshal message")
 		return
 	}
-	if err := s.activeChannel.Publish(exchangeName, queueWildcard, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        bytes,
-	}); err != nil {
+	s.send(routingKey(msg.Channel), bytes)
+}
+
+// send publishes the payload to the broker. Payloads that cannot be
+// published are held in a bounded outbox and sent again in order, after
+// reconnecting or once the broker accepts messages again.
+func (s *Server) send(key string, body []byte) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	if !s.degraded && s.flush() {
+		err := s.broker.Publish(key, body)
+		if err == nil {
+			return
+		}
 		logrus.WithFields(logrus.Fields{
-			"broker": s.broker.LocalAddr(),
-			"queue":  queuePrefix + "*",
+			"key": key,
+			"err": err,
 		}).Warn("Could not publish message")
+		if err == errBrokerClosed {
+			return
+		}
+	}
+	if s.outboxSize < 1 {
+		return
+	}
+	if len(s.outbox) >= s.outboxSize {
+		logrus.WithFields(logrus.Fields{
+			"key":  s.outbox[0].key,
+			"size": s.outboxSize,
+		}).Warn("Outbox is full, dropping oldest message")
+		s.outbox = s.outbox[1:]
+	}
+	s.outbox = append(s.outbox, pending{key, body})
+	if !s.degraded && !s.retrying {
+		s.retrying = true
+		time.AfterFunc(outboxRetry, s.retryOutbox)
+	}
+}
+
+// flush publishes the held payloads in order and reports whether the outbox is empty.
+func (s *Server) flush() bool {
+	for len(s.outbox) > 0 {
+		p := s.outbox[0]
+		if err := s.broker.Publish(p.key, p.body); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err":     err,
+				"pending": len(s.outbox),
+			}).Warn("Could not replay outbox")
+			return false
+		}
+		s.outbox = s.outbox[1:]
+	}
+	return true
+}
+
+// retryOutbox keeps flushing the outbox while the broker is connected but
+// refuses messages, for example because its queue is full.
+func (s *Server) retryOutbox() {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	s.retrying = false
+	if s.degraded || s.flush() {
+		return
+	}
+	s.retrying = true
+	time.AfterFunc(outboxRetry, s.retryOutbox)
+}
+
+func (s *Server) watchBroker(connected bool) {
+	s.outboxMu.Lock()
+	if !connected {
+		s.degraded = true
+		s.outboxMu.Unlock()
+		s.notice(degradedNotice)
+		return
+	}
+	replayed := len(s.outbox)
+	if !s.flush() {
+		s.outboxMu.Unlock()
+		return
+	}
+	s.degraded = false
+	s.outboxMu.Unlock()
+	logrus.WithField("replayed", replayed).Info("Replayed outbox after reconnect")
+	s.notice(restoredNotice)
+}
+
+// notice sends a system message to every local user without going through the broker.
+func (s *Server) notice(text string) {
+	for _, c := range s.ListChannels() {
+		c.broadcast(Message{
+			Sender:   s.Name,
+			Data:     text,
+			Channel:  c.Name,
+			Priority: PriorityLow,
+		})
 	}
 }
 
 func (s *Server) route(msg Message) {
-	channel, ok := s.channels[msg.Channel]
+	channel, ok := s.Channel(msg.Channel)
 	if !ok {
 		logrus.WithFields(logrus.Fields{
 			"channel": msg.Channel,
@@ -143,106 +433,96 @@ func (s *Server) route(msg Message) {
 		}).Warn("Could not route message")
 		return
 	}
-	channel.broadcast(msg)
+	channel.deliver(msg)
 }
 
-func (s *Server) consumeLoop() {
-	var err error
-	host, err := os.Hostname()
-	if err != nil {
-		// generate random bytes instead
-		rand.Seed(time.Now().Unix())
-		var randBytes [8]byte
-		rand.Read(randBytes[:])
-		host = hex.EncodeToString(randBytes[:])
-	}
-
-	s.activeChannel, err = s.broker.Channel()
-	if err != nil {
+func (s *Server) receive(key string, body []byte) {
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
 		logrus.WithFields(logrus.Fields{
-			"err":    err,
-			"broker": s.broker.LocalAddr(),
-		}).Fatal("Could not open channel")
+			"key": key,
+			"err": err,
+		}).Warn("Failed to consume message")
+		return
 	}
+	s.route(msg)
+}
 
-	if err := s.activeChannel.ExchangeDeclare(exchangeName, "topic", true, false, false, false, nil); err != nil {
+func (s *Server) subscribe(channel string) {
+	key := routingKey(channel)
+	if err := s.broker.Subscribe(key, s.receive); err != nil {
 		logrus.WithFields(logrus.Fields{
-			"exchange": exchangeName,
-			"err":      err,
-		}).Fatal("Could not declare exchange")
+			"channel": channel,
+			"key":     key,
+			"err":     err,
+		}).Warn("Could not subscribe to channel")
 	}
-	logrus.WithFields(logrus.Fields{
-		"exchange": exchangeName,
-	}).Info("Declared chat exchange")
+}
 
-	queue, err := s.activeChannel.QueueDeclare(queuePrefix+host, false, false, false, false, nil)
-	if err != nil {
+func (s *Server) unsubscribe(channel string) {
+	key := routingKey(channel)
+	if err := s.broker.Unsubscribe(key); err != nil {
 		logrus.WithFields(logrus.Fields{
-			"err":    err,
-			"broker": s.broker.LocalAddr(),
-			"name":   host,
-		}).Fatal("Could not declare queue")
+			"channel": channel,
+			"key":     key,
+			"err":     err,
+		}).Warn("Could not unsubscribe from channel")
 	}
-	logrus.WithFields(logrus.Fields{
-		"queue": queue.Name,
-	}).Info("Declared public queue")
+}
 
-	if err := s.activeChannel.QueueBind(queue.Name, queueWildcard, exchangeName, false, nil); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"err":    err,
-			"broker": s.broker.LocalAddr(),
-			"name":   host,
-		}).Fatal("Could not bind queue to exchange")
+func (s *Server) Connect(broker Broker) error {
+	if broker == nil {
+		return errors.New("no broker given")
 	}
-
-	for {
-		incoming, err := s.activeChannel.Consume(queue.Name, "", true, false, false, false, nil)
-		if err != nil {
-			s.activeChannel.Close()
-			s.activeChannel, err = s.broker.Channel()
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"err":    err,
-					"broker": s.broker.LocalAddr(),
-				}).Fatal("Could not open channel")
-			}
-		}
-		for payload := range incoming {
-			var msg Message
-			if err := json.Unmarshal(payload.Body, &msg); err != nil {
-				logrus.WithFields(logrus.Fields{
-					"id":    payload.MessageId,
-					"queue": queue.Name,
-				}).Warn("Failed to consume message")
-				continue
-			}
-			go s.route(msg)
+	for _, key := range []string{presenceKey, channelsKey, namesKey, sessionsKey, instanceKey(s.instance)} {
+		if err := broker.Subscribe(key, s.receiveEvent); err != nil {
+			return errors.Wrap(err, "could not subscribe to cluster events")
 		}
 	}
+	s.broker = broker
+	broker.Watch(s.watchBroker)
+	s.heartbeat()
+	go s.heartbeatLoop()
+	return nil
 }
 
-func (s *Server) Connect(broker string) error {
-	conn, err := amqp.Dial(broker)
-	if err != nil {
-		return errors.Wrap(err, "Could not init server")
+// randomID generates a random hex identifier of the given length in bytes.
+func randomID(size int) string {
+	randBytes := make([]byte, size)
+	if _, err := crand.Read(randBytes); err != nil {
+		rand.Read(randBytes)
 	}
-	logrus.WithFields(logrus.Fields{
-		"broker": broker,
-	}).Info("Connected to message queue")
-	s.broker = conn
-	go s.consumeLoop()
-	return nil
+	return hex.EncodeToString(randBytes)
 }
 
 func New(options ...Option) *Server {
 	rand.Seed(time.Now().Unix())
 	server := &Server{
-		Name:         defaultServerName,
-		motd:         defaultMOTD,
-		channels:     map[string]*Channel{},
-		textInterval: defaultTextInterval,
-		textLimit:    defaultTextLimit,
-		actions:      map[string]Action{},
+		Name:            defaultServerName,
+		instance:        randomID(8),
+		motd:            defaultMOTD,
+		channels:        map[string]*Channel{},
+		textInterval:    defaultTextInterval,
+		textLimit:       defaultTextLimit,
+		actions:         map[string]Action{},
+		aliases:         map[string]string{},
+		prefixes:        []string{defaultPrefix},
+		users:           map[string]*User{},
+		presence:        newPresence(),
+		removed:         newTombstones(),
+		channelPolicy:   DefaultChannelPolicy,
+		namePolicy:      DefaultNamePolicy,
+		claims:          newClaims(),
+		guests:          true,
+		sessions:        newSessions(),
+		sessionSecret:   []byte(randomID(32)),
+		gracePeriod:     defaultGracePeriod,
+		replaySize:      defaultReplaySize,
+		replayRetention: defaultReplayRetention,
+		actionTimeout:   DefaultActionTimeout,
+		outboxSize:      defaultOutboxSize,
+		sendQueue:       defaultSendQueue,
+		backpressure:    DropOldest,
 	}
 	for _, opt := range options {
 		opt(server)
@@ -298,3 +578,23 @@ func WithMainChannel(name string) Option {
 		s.defaultUserChannel = name
 	}
 }
+
+// WithOutboxSize sets how many messages are held while they cannot be
+// published. A size of zero disables the outbox.
+func WithOutboxSize(size int) Option {
+	return func(s *Server) {
+		s.outboxSize = size
+	}
+}
+
+func WithSendQueue(size int) Option {
+	return func(s *Server) {
+		s.sendQueue = size
+	}
+}
+
+func WithBackpressure(policy Backpressure) Option {
+	return func(s *Server) {
+		s.backpressure = policy
+	}
+}
@@ -0,0 +1,217 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// testUser creates a user without a connection whose outgoing frames are discarded.
+func testUser(s *Server, name string) *User {
+	user := &User{
+		name:     name,
+		host:     s,
+		channels: map[string]*Channel{},
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		actions:  make(chan invocation, actionQueue),
+		slots:    make(chan struct{}, actionQueue),
+	}
+	user.ctx, user.cancel = context.WithCancel(context.Background())
+	s.register(user)
+	go func() {
+		for {
+			select {
+			case <-user.wake:
+				user.dequeue()
+			case <-user.done:
+				return
+			}
+		}
+	}()
+	return user
+}
+
+func TestConcurrentClients(t *testing.T) {
+	const clients, rooms = 300, 10
+	s := New(WithChannels("main"), WithMainChannel("main"), WithName("test"))
+	if err := s.Connect(NewMemoryBroker()); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := testUser(s, fmt.Sprintf("user%d", i))
+			defer user.stop()
+			user.Join(s.mainChannel())
+			room := fmt.Sprintf("room%d", i%rooms)
+			if _, ok := s.Channel(room); !ok {
+				s.AddChannel(NewChannel(room, s))
+			}
+			s.AddAction(NewAction(fmt.Sprintf("action%d", i%rooms), "test", func(*Server, *Channel, *User, string) error {
+				return nil
+			}))
+			channel, ok := s.Channel(room)
+			if !ok {
+				t.Errorf("channel %s is missing", room)
+				return
+			}
+			user.Join(channel)
+			for j := 0; j < 5; j++ {
+				channel.Publish(Message{Sender: user.Name(), Data: "hello"})
+				channel.broadcast(Message{Sender: user.Name(), Data: "local"})
+				s.ListActions()
+				s.ListChannels()
+				channel.List()
+				channel.Names()
+			}
+			if err := user.Part(channel); err != nil {
+				t.Error(err)
+			}
+			user.partAll(true)
+			s.unregister(user)
+		}(i)
+	}
+	wg.Wait()
+	for _, c := range s.ListChannels() {
+		if members := c.List(); len(members) != 0 {
+			t.Errorf("%s still has %d members", c.Name, len(members))
+		}
+	}
+	if len(s.ListActions()) != len(DefaultActions)+rooms {
+		t.Errorf("expected %d actions, got %d", len(DefaultActions)+rooms, len(s.ListActions()))
+	}
+}
+
+func TestMainChannelAfterAdopt(t *testing.T) {
+	s := New()
+	s.receiveChannelEvent(event{Type: eventChannelCreate, Origin: "other", Channel: "fun", Name: "alice"})
+	main := s.mainChannel()
+	if main == nil || main.Name != defaultChannelName {
+		t.Fatalf("expected the default channel, got %v", main)
+	}
+	if s.entryChannel(RoleGuest) != main {
+		t.Error("expected guests to enter the default channel")
+	}
+}
+
+func TestClaimNameAlone(t *testing.T) {
+	s := New()
+	if err := s.Connect(NewMemoryBroker()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	c, ok := s.claimName("alice", false)
+	if !ok || time.Since(start) >= claimTimeout {
+		t.Errorf("expected the claim to succeed right away, took %v", time.Since(start))
+	}
+	s.claims.finish("alice", c)
+}
+
+func TestVerifiedNameEvictsGuest(t *testing.T) {
+	s := New(WithChannels("main"), WithMainChannel("main"), WithName("test"))
+	if err := s.Connect(NewMemoryBroker()); err != nil {
+		t.Fatal(err)
+	}
+	guest := testUser(s, "Alice")
+	defer guest.stop()
+	if err := s.takeName("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if name := guest.Name(); name == "Alice" || s.nameTaken("alice", nil) {
+		t.Errorf("expected the guest to be renamed, still called %s", name)
+	}
+	verified := testUser(s, "alice")
+	defer verified.stop()
+	verified.verified = true
+	if err := s.takeName("Alice"); err == nil {
+		t.Error("expected the name of a verified user to be refused")
+	}
+}
+
+// reserving authenticates every request as the same verified user.
+type reserving Identity
+
+func (r reserving) Authenticate(*http.Request) (*Identity, error) {
+	identity := Identity(r)
+	return &identity, nil
+}
+
+func (r reserving) Reserves(name string) bool {
+	return strings.EqualFold(name, r.Name)
+}
+
+func TestVerifiedNamePolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"alice", true},
+		{"Test", false},
+		{"a", false},
+		{"-alice", false},
+	}
+	for _, test := range tests {
+		s := New(WithName("test"), WithAuthenticator(reserving{Name: test.name}))
+		if err := s.Connect(NewMemoryBroker()); err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(s.Handler())
+		resp, err := http.Get(server.URL)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if forbidden := resp.StatusCode == http.StatusForbidden; forbidden == test.ok {
+			t.Errorf("%s: expected ok=%v, got %s", test.name, test.ok, resp.Status)
+		}
+	}
+}
+
+func TestSessionSharedCookie(t *testing.T) {
+	s := New()
+	if err := s.Connect(NewMemoryBroker()); err != nil {
+		t.Fatal(err)
+	}
+	sess := &session{id: "tab", name: "alice"}
+	s.attach(sess, testUser(s, "alice"), "")
+	token := s.sessionToken(sess.id, "alice")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	if other, err := s.session(r, nil); err != nil || other.id == sess.id || other.name == "alice" {
+		t.Errorf("expected a second tab to get its own session, got %+v, %v", other, err)
+	}
+	r = httptest.NewRequest("GET", "/?"+sessionParam+"="+token, nil)
+	if resumed, err := s.session(r, nil); err != nil || resumed != sess {
+		t.Errorf("expected an explicit resume to take over the session, got %+v, %v", resumed, err)
+	}
+}
+
+func TestHandshakeOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"http://chat.example.com", true},
+		{"https://evil.example.com", false},
+		{"null", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://chat.example.com/", nil)
+		r.Header.Set("Origin", test.origin)
+		if err := handshake(&websocket.Config{Version: websocket.ProtocolVersionHybi13}, r); (err == nil) != test.ok {
+			t.Errorf("%s: expected ok=%v, got %v", test.origin, test.ok, err)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	sessionCookie      = "webchat_session"
+	sessionParam       = "session"
+	sessionsKey        = clusterPrefix + "sessions"
+	eventSessionDetach = "session.detach"
+	eventSessionResume = "session.resume"
+	defaultGracePeriod = 30 * time.Second
+	sessionTTL         = 24 * time.Hour
+)
+
+// session ties reconnecting clients to their previous identity. While a
+// session is detached its user stays in its channels for the grace period,
+// so a quick reconnect is not announced.
+type session struct {
+	id       string
+	name     string
+	channels []string
+	current  string
+	user     *User
+	detached bool
+	origin   string
+	timer    *time.Timer
+	seen     time.Time
+	buffer   *replay
+}
+
+type sessions struct {
+	mu   sync.Mutex
+	byID map[string]*session
+}
+
+type sessionKey struct{}
+
+type sessionClaims struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func newSessions() *sessions {
+	return &sessions{byID: map[string]*session{}}
+}
+
+// lookup returns a known session, the name it currently maps to and whether
+// the name is still held by a connected or detached user.
+func (st *sessions) lookup(id string, grace time.Duration) (*session, string, bool, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, ok := st.byID[id]
+	if !ok {
+		return nil, "", false, false
+	}
+	held := sess.user != nil || (sess.origin != "" && time.Since(sess.seen) < grace)
+	return sess, sess.name, held, true
+}
+
+// connected reports whether the session is in use by a connection.
+func (st *sessions) connected(sess *session) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return sess.user != nil && !sess.detached
+}
+
+func (st *sessions) nameOf(sess *session) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return sess.name
+}
+
+func (st *sessions) rename(id, name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if sess, ok := st.byID[id]; ok {
+		sess.name = name
+	}
+}
+
+// expire forgets sessions that have not been used for sessionTTL.
+func (st *sessions) expire() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, sess := range st.byID {
+		if sess.user == nil && time.Since(sess.seen) > sessionTTL {
+			delete(st.byID, id)
+		}
+	}
+}
+
+// sessionToken signs the session ID together with the name it maps to.
+func (s *Server) sessionToken(id, name string) string {
+	payload, _ := json.Marshal(sessionClaims{ID: id, Name: name})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, s.sessionSecret)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) parseSessionToken(token string) (sessionClaims, error) {
+	var claims sessionClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, errors.New("malformed session token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.Wrap(err, "could not read session signature")
+	}
+	mac := hmac.New(sha256.New, s.sessionSecret)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return claims, errors.New("invalid session signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.Wrap(err, "could not read session token")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.Wrap(err, "could not read session token")
+	}
+	return claims, nil
+}
+
+// session finds the session a request resumes or starts a new one.
+// Verified identities only resume sessions issued for the same name. A
+// session that is still connected is only taken over when the client passes
+// it explicitly, so that several tabs sharing the cookie get their own.
+func (s *Server) session(r *http.Request, identity *Identity) (*session, error) {
+	token := r.URL.Query().Get(sessionParam)
+	explicit := token != ""
+	if cookie, err := r.Cookie(sessionCookie); err == nil && !explicit {
+		token = cookie.Value
+	}
+	if token != "" {
+		claims, err := s.parseSessionToken(token)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"remote": r.RemoteAddr,
+				"err":    err,
+			}).Debug("Ignoring session token")
+		} else if sess, name, held, ok := s.sessions.lookup(claims.ID, s.gracePeriod); ok {
+			// the session may have been renamed since the token was issued
+			if (identity == nil || identity.Name == name) && (held || !s.nameTaken(name, nil)) && (explicit || !s.sessions.connected(sess)) {
+				return sess, nil
+			}
+		} else if (identity == nil || identity.Name == claims.Name) && !s.nameTaken(claims.Name, nil) {
+			return &session{id: claims.ID, name: claims.Name}, nil
+		}
+	}
+	if identity == nil {
+		name, err := s.generateName()
+		if err != nil {
+			return nil, err
+		}
+		return &session{id: randomID(16), name: name}, nil
+	}
+	if err := s.takeName(identity.Name); err != nil {
+		return nil, err
+	}
+	return &session{id: randomID(16), name: identity.Name}, nil
+}
+
+// sessionHeader carries the session cookie in the handshake response.
+func (s *Server) sessionHeader(r *http.Request, token string) http.Header {
+	cookie := http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+	return http.Header{"Set-Cookie": {cookie.String()}}
+}
+
+func withSession(r *http.Request, sess *session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, sess))
+}
+
+func sessionOf(r *http.Request) *session {
+	sess, _ := r.Context().Value(sessionKey{}).(*session)
+	return sess
+}
+
+// attach binds a new connection to its session and replays the messages
+// after last. It reports whether the user got its channels back.
+func (s *Server) attach(sess *session, user *User, last string) bool {
+	s.sessions.mu.Lock()
+	previous, detached := sess.user, sess.detached
+	elsewhere := sess.origin != "" && sess.origin != s.instance
+	remote := elsewhere && time.Since(sess.seen) < s.gracePeriod
+	buffered := elsewhere && time.Since(sess.seen) < s.replayRetention
+	channels, current := sess.channels, sess.current
+	if sess.timer != nil {
+		sess.timer.Stop()
+		sess.timer = nil
+	}
+	sess.user, sess.detached, sess.origin, sess.seen = user, false, s.instance, time.Now()
+	if sess.buffer == nil {
+		sess.buffer = newReplay(s.replaySize, s.replayRetention)
+	}
+	s.sessions.byID[sess.id] = sess
+	s.sessions.mu.Unlock()
+
+	user.session, user.buffer = sess.id, sess.buffer
+	if previous != nil {
+		if !detached {
+			// an explicit resume replaces the previous connection
+			previous.conn.Close()
+		}
+		if last != "" {
+			user.pause()
+		}
+		s.unregister(previous)
+		s.register(user)
+		user.takeOver(previous)
+		if last != "" {
+			user.resume(sess.buffer.since(last))
+		}
+		return true
+	}
+	s.register(user)
+	if buffered && last != "" {
+		s.replayTo(user, sess, last)
+	} else if remote {
+		s.emit(sessionsKey, event{
+			Type:    eventSessionResume,
+			Origin:  s.instance,
+			Session: sess.id,
+		})
+	} else if last != "" {
+		user.pause()
+		defer func() {
+			user.resume(sess.buffer.since(last))
+		}()
+	}
+	restored := false
+	for _, name := range channels {
+		if channel, ok := s.Channel(name); ok && channel.CanJoin(user) && user.join(channel, !remote) == nil {
+			restored = true
+		}
+	}
+	if channel, ok := user.Member(current); ok {
+		user.Switch(channel)
+	}
+	return restored
+}
+
+// detach keeps a disconnected user in its channels for the grace period.
+func (s *Server) detach(user *User) {
+	s.sessions.mu.Lock()
+	sess, ok := s.sessions.byID[user.session]
+	if ok && sess.user != user {
+		// the connection was replaced by a newer one
+		s.sessions.mu.Unlock()
+		return
+	}
+	if !ok || s.gracePeriod <= 0 {
+		if ok {
+			sess.user, sess.channels, sess.current = nil, user.channelNames(), user.currentName()
+			sess.seen = time.Now()
+			if sess.buffer != nil {
+				sess.buffer.leave()
+			}
+		}
+		s.sessions.mu.Unlock()
+		s.unregister(user)
+		user.partAll(true)
+		return
+	}
+	sess.detached = true
+	sess.channels, sess.current = user.channelNames(), user.currentName()
+	sess.seen = time.Now()
+	sess.timer = time.AfterFunc(s.gracePeriod, func() {
+		s.expireSession(sess, user)
+	})
+	channels, current := sess.channels, sess.current
+	s.sessions.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"user":    user.Name(),
+		"session": sess.id,
+	}).Debug("Detached session")
+	s.emit(sessionsKey, event{
+		Type:     eventSessionDetach,
+		Origin:   s.instance,
+		Session:  sess.id,
+		Name:     user.Name(),
+		Channels: channels,
+		Channel:  current,
+	})
+}
+
+// expireSession lets a detached user leave once the grace period is over.
+func (s *Server) expireSession(sess *session, user *User) {
+	s.sessions.mu.Lock()
+	if sess.user != user || !sess.detached {
+		s.sessions.mu.Unlock()
+		return
+	}
+	sess.user, sess.detached, sess.timer = nil, false, nil
+	if sess.buffer != nil {
+		sess.buffer.leave()
+	}
+	s.sessions.mu.Unlock()
+	s.unregister(user)
+	user.partAll(true)
+}
+
+func (s *Server) receiveSession(ev event) {
+	switch ev.Type {
+	case eventSessionDetach:
+		s.sessions.mu.Lock()
+		defer s.sessions.mu.Unlock()
+		sess, ok := s.sessions.byID[ev.Session]
+		if !ok {
+			sess = &session{id: ev.Session}
+			s.sessions.byID[ev.Session] = sess
+		} else if sess.user != nil {
+			return
+		}
+		sess.name, sess.channels, sess.current = ev.Name, ev.Channels, ev.Channel
+		sess.origin, sess.seen = ev.Origin, time.Now()
+	case eventSessionResume:
+		s.sessions.mu.Lock()
+		sess, ok := s.sessions.byID[ev.Session]
+		if ok && sess.user == nil && sess.origin == s.instance {
+			// the session left its channels, but its messages are still buffered
+			buffer := sess.buffer
+			sess.origin = ev.Origin
+			s.sessions.mu.Unlock()
+			s.sendReplay(ev, buffer)
+			return
+		}
+		if !ok || sess.user == nil || !sess.detached {
+			s.sessions.mu.Unlock()
+			return
+		}
+		user, buffer := sess.user, sess.buffer
+		if sess.timer != nil {
+			sess.timer.Stop()
+		}
+		sess.user, sess.detached, sess.timer, sess.origin = nil, false, nil, ev.Origin
+		s.sessions.mu.Unlock()
+		logrus.WithFields(logrus.Fields{
+			"user":   user.Name(),
+			"origin": ev.Origin,
+		}).Debug("Session resumed on another instance")
+		s.sendReplay(ev, buffer)
+		s.unregister(user)
+		user.partAll(false)
+	}
+}
+
+func WithSessionSecret(secret []byte) Option {
+	return func(s *Server) {
+		s.sessionSecret = secret
+	}
+}
+
+func WithGracePeriod(grace time.Duration) Option {
+	return func(s *Server) {
+		s.gracePeriod = grace
+	}
+}
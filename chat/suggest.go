@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+)
+
+// unknownAction builds the notice for an unknown action, suggesting the
+// closest action known to the role if there is one.
+func (s *Server) unknownAction(name string, role Role) string {
+	prefix := s.prefix()
+	if match, ok := closest(name, s.actionNames(role)); ok {
+		return fmt.Sprintf("Unknown action %s%s, did you mean %s%s?", prefix, name, prefix, match)
+	}
+	return fmt.Sprintf("Unknown action %s%s, use %shelp to list all actions.", prefix, name, prefix)
+}
+
+// closest returns the candidate with the smallest edit distance to name,
+// as long as the distance is small enough to be a plausible typo.
+func closest(name string, candidates []string) (string, bool) {
+	sort.Strings(candidates)
+	best, bestDistance := "", len(name)/2+1
+	for _, c := range candidates {
+		if d := distance(name, c); d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+	return best, best != ""
+}
+
+// distance computes the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const eventTopic = "channel.topic"
+
+// topic is the replicated topic of a channel. The most recent change wins.
+type topic struct {
+	Text string `json:"text"`
+	By   string `json:"by,omitempty"`
+	Time int64  `json:"time,omitempty"`
+}
+
+// ChannelOption configures a channel.
+type ChannelOption func(c *Channel)
+
+func WithTopic(text string) ChannelOption {
+	return func(c *Channel) {
+		c.topic = topic{Text: text}
+	}
+}
+
+func WithWelcome(text string) ChannelOption {
+	return func(c *Channel) {
+		c.welcome = text
+	}
+}
+
+// WithLockedTopic restricts topic changes to moderators and the owner of the channel.
+func WithLockedTopic() ChannelOption {
+	return func(c *Channel) {
+		c.permissions.Topic = RoleModerator
+	}
+}
+
+func (c *Channel) Topic() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.topic.Text
+}
+
+// SetTopic changes the topic on behalf of a user and replicates it to all instances.
+func (c *Channel) SetTopic(text string, user *User) error {
+	c.mu.RLock()
+	locked := user.Role() < c.permissions.Topic && c.Owner != user.Name()
+	c.mu.RUnlock()
+	if locked {
+		return forbid("The topic of %s is locked, you need to be a %s to change it.", c.Name, c.permissions.Topic)
+	}
+	change := topic{
+		Text: text,
+		By:   user.Name(),
+		Time: time.Now().UnixNano(),
+	}
+	c.updateTopic(change)
+	c.host.emit(channelsKey, event{
+		Type:   eventTopic,
+		Origin: c.host.instance,
+		Topics: map[string]topic{c.Name: change},
+	})
+	return nil
+}
+
+// updateTopic applies a topic change if it is newer than the current one
+// and tells the local members about it.
+func (c *Channel) updateTopic(change topic) bool {
+	c.mu.Lock()
+	if change.Time <= c.topic.Time {
+		c.mu.Unlock()
+		return false
+	}
+	c.topic = change
+	c.mu.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"channel": c.Name,
+		"by":      change.By,
+	}).Debug("Changed channel topic")
+	c.broadcast(Message{
+		Sender:   c.host.Name,
+		Data:     change.By + " changed the topic to: " + change.Text,
+		Channel:  c.Name,
+		Priority: PriorityLow,
+	})
+	return true
+}
+
+// greet shows the topic and welcome message to a joining user.
+func (c *Channel) greet(u *User) {
+	c.mu.RLock()
+	text, welcome := c.topic.Text, c.welcome
+	c.mu.RUnlock()
+	if text != "" {
+		u.Send(Message{
+			Sender:   c.host.Name,
+			Data:     "Topic of " + c.Name + ": " + text,
+			Channel:  c.Name,
+			Priority: PriorityLow,
+		})
+	}
+	if welcome != "" {
+		u.Send(Message{
+			Sender:  c.host.Name,
+			Data:    welcome,
+			Channel: c.Name,
+		})
+	}
+}
+
+// topics collects the topics changed at runtime, so new instances can catch up.
+func (s *Server) topics() map[string]topic {
+	topics := map[string]topic{}
+	for _, c := range s.ListChannels() {
+		c.mu.RLock()
+		if c.topic.Time > 0 {
+			topics[c.Name] = c.topic
+		}
+		c.mu.RUnlock()
+	}
+	return topics
+}
+
+func (s *Server) receiveTopics(topics map[string]topic) {
+	for name, change := range topics {
+		if channel, ok := s.Channel(name); ok {
+			channel.updateTopic(change)
+		}
+	}
+}
+
+func WithChannel(name string, options ...ChannelOption) Option {
+	return func(s *Server) {
+		s.AddChannel(NewChannel(name, s, options...))
+	}
+}
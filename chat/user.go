@@ -1,11 +1,14 @@
 package chat
 
 import (
+	"context"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/moby/moby/pkg/namesgenerator"
 	"golang.org/x/net/websocket"
 )
 
@@ -14,73 +17,257 @@ const (
 	PriorityLow  = "muted"
 )
 
+const typingInterval = 2 * time.Second
+
+// Message is a chat message. ID, Time (milliseconds since the epoch), Origin
+// and Sequence are assigned by Channel.Publish on the instance it came from.
 type Message struct {
+	ID       string `json:"id,omitempty"`
+	Time     int64  `json:"time,omitempty"`
 	Sender   string `json:"sender"`
+	To       string `json:"to,omitempty"`
 	Data     string `json:"data"`
 	Priority string `json:"priority"`
 	Channel  string `json:"channel"`
 	Media    string `json:"media"`
+	Origin   string `json:"origin,omitempty"`
+	Sequence uint64 `json:"seq,omitempty"`
+	Kind     string `json:"kind,omitempty"`
 }
 
 type User struct {
-	Name   string
-	conn   *websocket.Conn
-	active *Channel
-	host   *Server
+	name       string
+	conn       *websocket.Conn
+	structured bool
+	host       *Server
+	mu         sync.RWMutex
+	channels   map[string]*Channel
+	active     *Channel
+	replyTo    string
+	lastTyping time.Time
+	role       Role
+	verified   bool
+	session    string
+	buffer     *replay
+	outMu      sync.Mutex
+	out        []Frame
+	closed     bool
+	paused     bool
+	held       []Frame
+	wake       chan struct{}
+	done       chan struct{}
+	actions    chan invocation
+	slots      chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
 func (user *User) Watch() {
 	logrus.WithFields(logrus.Fields{
-		"user": user.Name,
+		"user":       user.Name(),
+		"structured": user.structured,
 	}).Debug("Watching user input")
-	var text string
 	var lastMessage time.Time
 	for {
-		if err := websocket.Message.Receive(user.conn, &text); err != nil {
-			break
-		}
-		if interval := time.Since(lastMessage); interval < user.host.textInterval {
+		frame, err := user.receive()
+		if derr, ok := err.(decodeError); ok {
+			user.reject("", ErrorBadFrame, "Could not decode frame: "+derr.Error())
 			continue
+		} else if err != nil {
+			break
 		}
-		lastMessage = time.Now()
-		if len(text) > user.host.textLimit {
-			continue
+		if frame.Type == FrameMessage || frame.Type == FrameCommand || frame.Type == FrameDirect {
+			if interval := time.Since(lastMessage); interval < user.host.textInterval {
+				user.reject(frame.ID, ErrorRateLimited, fmt.Sprintf("You are sending messages too fast, please wait %v between messages.", user.host.textInterval))
+				continue
+			}
+			lastMessage = time.Now()
+			if length := utf8.RuneCountInString(frame.Data + frame.Args); length > user.host.textLimit {
+				user.reject(frame.ID, ErrorTooLong, fmt.Sprintf("Your message is %d characters long, the limit is %d characters.", length, user.host.textLimit))
+				continue
+			}
 		}
 		logrus.WithFields(logrus.Fields{
-			"message": text,
-			"user":    user.Name,
-		}).Debug("Received message from user")
-		text = strings.TrimSpace(text)
+			"type": frame.Type,
+			"id":   frame.ID,
+			"user": user.Name(),
+		}).Debug("Received frame from user")
+		user.handle(frame)
+	}
+	close(user.actions)
+	user.cancel()
+	user.stop()
+	user.host.detach(user)
+	logrus.WithFields(logrus.Fields{
+		"user": user.Name(),
+	}).Debug("Closing connection")
+}
+
+func (user *User) handle(frame Frame) {
+	if frame.Version > ProtocolVersion {
+		user.reject(frame.ID, ErrorBadVersion, fmt.Sprintf("Protocol version %d is not supported, the server speaks version %d.", frame.Version, ProtocolVersion))
+		return
+	}
+	switch frame.Type {
+	case FramePing:
+		user.sendFrame(Frame{Type: FramePong, ID: frame.ID})
+	case FrameMessage:
+		text := strings.TrimSpace(frame.Data)
 		if len(text) < 1 {
-			continue
+			return
 		}
-		command := strings.SplitN(text, " ", 2)
-		if action, ok := user.host.actions[command[0]]; ok {
-			err := action.Invoke(user.host, user.active, user, command[len(command)-1])
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"user":    user.Name,
-					"channel": user.active.Name,
-					"action":  command[0],
-					"error":   err,
-				}).Warn("Failed to invoke action")
-			}
-			continue
+		channel, ok := user.writeTarget(frame)
+		if !ok {
+			return
 		}
-		user.active.Publish(Message{
-			Sender:  user.Name,
+		channel.Publish(Message{
+			Sender:  user.Name(),
 			Data:    text,
-			Channel: user.active.Name,
+			Channel: channel.Name,
+		})
+		user.ack(frame.ID)
+	case FrameTyping:
+		channel, ok := user.writeTarget(frame)
+		if !ok {
+			return
+		}
+		// clients report typing per keystroke, only one notice per interval is relayed
+		if time.Since(user.lastTyping) < typingInterval {
+			user.ack(frame.ID)
+			return
+		}
+		user.lastTyping = time.Now()
+		channel.Publish(Message{
+			Sender:  user.Name(),
+			Channel: channel.Name,
+			Kind:    KindTyping,
 		})
+		user.ack(frame.ID)
+	case FrameCommand:
+		user.invoke(frame.ID, frame.Name, frame.Args)
+	case FrameDirect:
+		to := frame.Name
+		if to == "" {
+			to = user.ReplyTo()
+		}
+		if strings.TrimSpace(frame.Data) == "" {
+			user.reject(frame.ID, ErrorBadFrame, "Direct messages must not be empty.")
+			return
+		}
+		if err := user.host.Direct(user, to, frame.Data); err != nil {
+			user.reject(frame.ID, ErrorUnknownUser, err.Error())
+			return
+		}
+		user.ack(frame.ID)
+	case FrameJoin, FramePart, FrameNick:
+		if _, ok := user.host.Action(frame.Type); !ok {
+			user.reject(frame.ID, ErrorUnsupported, "The server does not support "+frame.Type+".")
+			return
+		}
+		args := frame.Channel
+		if frame.Type == FrameNick {
+			args = frame.Name
+		}
+		user.invoke(frame.ID, frame.Type, args)
+	case "":
+		user.reject(frame.ID, ErrorBadFrame, "Frame is missing a type.")
+	default:
+		user.reject(frame.ID, ErrorUnknownType, "Unknown frame type "+frame.Type+".")
+	}
+}
+
+// target resolves the channel a frame is sent to, defaulting to the current one.
+func (user *User) target(frame Frame) (*Channel, bool) {
+	if frame.Channel == "" {
+		if channel := user.Current(); channel != nil {
+			return channel, true
+		}
+		user.reject(frame.ID, ErrorNotMember, "You are not a member of any channel.")
+		return nil, false
+	}
+	channel, ok := user.Member(frame.Channel)
+	if !ok {
+		user.reject(frame.ID, ErrorNotMember, "You are not a member of channel "+frame.Channel+".")
+	}
+	return channel, ok
+}
+
+// writeTarget resolves the channel a frame is sent to and checks that the
+// user may write to it.
+func (user *User) writeTarget(frame Frame) (*Channel, bool) {
+	channel, ok := user.target(frame)
+	if ok && !channel.CanWrite(user) {
+		user.reject(frame.ID, ErrorForbidden, fmt.Sprintf("You need to be a %s to write in %s.", channel.permissions.Write, channel.Name))
+		return nil, false
+	}
+	return channel, ok
+}
+
+func (user *User) invoke(id, name, args string) {
+	action, ok := user.host.Action(name)
+	if !ok {
+		user.reject(id, ErrorUnknownCommand, user.host.unknownAction(name, user.Role()))
+		return
+	}
+	if user.Role() < action.Role {
+		user.reject(id, ErrorForbidden, fmt.Sprintf("You need to be a %s to use %s%s.", action.Role, user.host.prefix(), action.Name))
+		return
+	}
+	values, err := action.parse(user.host, args)
+	if err != nil {
+		user.reject(id, ErrorBadArguments, err.Error()+" Usage: "+action.Usage(user.host.prefix()))
+		return
+	}
+	handler := action.Run
+	if handler == nil {
+		handler = Adapt(action.Invoke)
+	}
+	channel := user.Current()
+	ctx, cancel := context.WithTimeout(user.ctx, user.host.actionTimeout)
+	inv := invocation{
+		ctx: &Context{
+			Context: ctx,
+			Server:  user.host,
+			Channel: channel,
+			User:    user,
+			Action:  action,
+			Args:    values,
+			Command: args,
+			Message: Message{
+				ID:      randomID(16),
+				Time:    time.Now().UnixNano() / int64(time.Millisecond),
+				Sender:  user.Name(),
+				Data:    strings.TrimSpace(user.host.prefix() + action.Name + " " + args),
+				Channel: channel.Name,
+			},
+			id: id,
+		},
+		cancel:  cancel,
+		handler: handler,
+	}
+	select {
+	case user.slots <- struct{}{}:
+	default:
+		cancel()
+		user.reject(id, ErrorRateLimited, "Too many of your actions are still running, please wait for them to finish.")
+		return
+	}
+	// serial actions change what the following frames refer to, so they run
+	// right away instead of waiting behind the queue
+	if action.serial {
+		user.run(inv)
+	} else {
+		user.actions <- inv
 	}
-	user.active.Leave(user)
-	logrus.WithFields(logrus.Fields{
-		"user": user.Name,
-	}).Debug("Closing connection")
 }
 
 func (user *User) Send(msg Message) error {
-	return websocket.JSON.Send(user.conn, msg)
+	user.record(msg)
+	return user.enqueue(Frame{Type: FrameMessage, Message: &msg})
+}
+
+func (user *User) sendFrame(frame Frame) error {
+	return user.enqueue(frame)
 }
 
 func Capitalize(s ...string) []string {
@@ -97,11 +284,35 @@ func Capitalize(s ...string) []string {
 	return s
 }
 
-func NewUser(conn *websocket.Conn, host *Server) *User {
-	name := namesgenerator.GetRandomName(0)
-	return &User{
-		Name: strings.Join(Capitalize(strings.Split(name, "_")...), " "),
-		conn: conn,
-		host: host,
+// NewUser creates a user for the connection. Users without a verified
+// identity are guests with a generated name. It fails if no free name is found.
+func NewUser(conn *websocket.Conn, host *Server, identity *Identity) (*User, error) {
+	var name string
+	if identity != nil {
+		name = identity.Name
+	} else {
+		var err error
+		if name, err = host.generateName(); err != nil {
+			return nil, err
+		}
+	}
+	user := &User{
+		name:       name,
+		conn:       conn,
+		structured: structured(conn),
+		host:       host,
+		role:       host.role(identity),
+		channels:   map[string]*Channel{},
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		actions:    make(chan invocation, actionQueue),
+		slots:      make(chan struct{}, actionQueue),
+	}
+	user.ctx, user.cancel = context.WithCancel(context.Background())
+	if identity != nil {
+		user.verified = !identity.Guest
 	}
+	go user.writeLoop()
+	go user.runActions()
+	return user, nil
 }
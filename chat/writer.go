@@ -0,0 +1,134 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultSendQueue = 64
+	writeTimeout     = 10 * time.Second
+)
+
+// Backpressure decides what happens when a client cannot keep up with its outbound queue.
+type Backpressure int
+
+const (
+	// DropOldest discards the oldest queued message.
+	DropOldest Backpressure = iota
+	// DropLowPriority discards queued PriorityLow messages and other
+	// low priority frames first, then the oldest one.
+	DropLowPriority
+	// Disconnect closes the connection of the slow client.
+	Disconnect
+)
+
+var errUserDisconnected = errors.New("user is disconnected")
+
+// enqueue appends the frame to the outbound queue, applying the server's
+// backpressure policy if the queue is full.
+func (user *User) enqueue(frame Frame) error {
+	user.outMu.Lock()
+	defer user.outMu.Unlock()
+	if user.closed {
+		return errUserDisconnected
+	}
+	if user.paused {
+		if len(user.held) > 0 && len(user.held) >= user.host.sendQueue {
+			user.held = user.held[1:]
+		}
+		user.held = append(user.held, frame)
+		return nil
+	}
+	if len(user.out) > 0 && len(user.out) >= user.host.sendQueue {
+		switch user.host.backpressure {
+		case Disconnect:
+			logrus.WithFields(logrus.Fields{
+				"user":  user.Name(),
+				"queue": len(user.out),
+			}).Warn("Disconnecting slow consumer")
+			user.closed = true
+			user.conn.Close()
+			return errUserDisconnected
+		case DropLowPriority:
+			if !user.dropLowPriority() {
+				if frame.low() {
+					return nil
+				}
+				user.out = user.out[1:]
+			}
+		default:
+			user.out = user.out[1:]
+		}
+		logrus.WithFields(logrus.Fields{
+			"user":  user.Name(),
+			"queue": len(user.out),
+		}).Debug("Dropped message for slow consumer")
+	}
+	user.out = append(user.out, frame)
+	select {
+	case user.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dropLowPriority removes the oldest queued low priority frame.
+func (user *User) dropLowPriority() bool {
+	for i, f := range user.out {
+		if f.low() {
+			user.out = append(user.out[:i], user.out[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (user *User) dequeue() []Frame {
+	user.outMu.Lock()
+	defer user.outMu.Unlock()
+	batch := user.out
+	user.out = nil
+	return batch
+}
+
+// writeLoop drains the outbound queue until the user disconnects.
+func (user *User) writeLoop() {
+	for {
+		select {
+		case <-user.wake:
+		case <-user.done:
+			return
+		}
+		for _, frame := range user.dequeue() {
+			payload, ok := user.encode(frame)
+			if !ok {
+				continue
+			}
+			user.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := websocket.JSON.Send(user.conn, payload); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"user": user.Name(),
+					"err":  err,
+				}).Debug("Could not write to connection")
+				user.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// stop shuts down the writer and rejects further messages.
+func (user *User) stop() {
+	user.outMu.Lock()
+	defer user.outMu.Unlock()
+	user.closed = true
+	select {
+	case <-user.done:
+	default:
+		close(user.done)
+	}
+}
@@ -2,10 +2,15 @@ package config
 
 import (
 	"io/ioutil"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/lnsp/webchat/chat"
+	"github.com/lnsp/webchat/chat/auth"
 	"github.com/lnsp/webchat/chat/blueprint"
 	"github.com/pkg/errors"
 	yaml "gopkg.in/yaml.v2"
@@ -21,18 +26,90 @@ type Action struct {
 	Data        string                `yaml:"data"`
 	Sender      string                `yaml:"sender"`
 	Channel     string                `yaml:"channel"`
+	Role        string                `yaml:"role"`
+	Broadcast   bool                  `yaml:"broadcast"`
+	URL         string                `yaml:"url"`
+	Timeout     int                   `yaml:"timeout"`
+	Secret      string                `yaml:"secret"`
+	Args        []Arg                 `yaml:"args"`
+	Aliases     []string              `yaml:"aliases"`
+	Group       string                `yaml:"group"`
+	Hidden      bool                  `yaml:"hidden"`
 	Middleware  map[string]Middleware `yaml:"middleware"`
 }
 
+// Arg declares an argument of an action.
+type Arg struct {
+	Name        string `yaml:"name"`
+	Type        string `yaml:"type"`
+	Description string `yaml:"description"`
+	Optional    bool   `yaml:"optional"`
+}
+
+// Channel is either a plain channel name or a mapping with further settings.
+type Channel struct {
+	Name      string `yaml:"name"`
+	Topic     string `yaml:"topic"`
+	Welcome   string `yaml:"welcome"`
+	LockTopic bool   `yaml:"lockTopic"`
+	Read      string `yaml:"read"`
+	Write     string `yaml:"write"`
+	Join      string `yaml:"join"`
+	TopicRole string `yaml:"topicRole"`
+}
+
+func (c *Channel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.Name); err == nil {
+		return nil
+	}
+	type plain Channel
+	return unmarshal((*plain)(c))
+}
+
+type ChannelPolicy struct {
+	Create      string `yaml:"create"`
+	NamePattern string `yaml:"namePattern"`
+	MaxChannels int    `yaml:"maxChannels"`
+	TTL         int    `yaml:"ttl"`
+}
+
+type NamePolicy struct {
+	MinLength int      `yaml:"minLength"`
+	MaxLength int      `yaml:"maxLength"`
+	Pattern   string   `yaml:"pattern"`
+	Reserved  []string `yaml:"reserved"`
+}
+
+// Auth configures how connections are authenticated. Guests are allowed
+// unless explicitly disabled.
+type Auth struct {
+	Guests        *bool  `yaml:"guests"`
+	Secret        string `yaml:"secret"`
+	Htpasswd      string `yaml:"htpasswd"`
+	SessionSecret string `yaml:"sessionSecret"`
+}
+
 type Chat struct {
-	Actions  []Action `yaml:"actions"`
-	Channels []string `yaml:"channels,flow"`
-	General  struct {
-		Name            string `yaml:"name"`
-		MOTD            string `yaml:"motd"`
-		CharacterLimit  int    `yaml:"characterLimit"`
-		MessageInterval int    `yaml:"messageInterval"`
-		MainChannel     string `yaml:"mainChannel"`
+	Actions       []Action            `yaml:"actions"`
+	Channels      []Channel           `yaml:"channels,flow"`
+	ChannelPolicy *ChannelPolicy      `yaml:"channelPolicy"`
+	NamePolicy    *NamePolicy         `yaml:"namePolicy"`
+	Auth          Auth                `yaml:"auth"`
+	Roles         map[string][]string `yaml:"roles"`
+	General       struct {
+		Name            string   `yaml:"name"`
+		MOTD            string   `yaml:"motd"`
+		CharacterLimit  int      `yaml:"characterLimit"`
+		MessageInterval int      `yaml:"messageInterval"`
+		MainChannel     string   `yaml:"mainChannel"`
+		OutboxSize      *int     `yaml:"outboxSize"`
+		SendQueue       int      `yaml:"sendQueue"`
+		Backpressure    string   `yaml:"backpressure"`
+		GracePeriod     *int     `yaml:"gracePeriod"`
+		ReplaySize      int      `yaml:"replaySize"`
+		ReplayRetention int      `yaml:"replayRetention"`
+		ActionTimeout   int      `yaml:"actionTimeout"`
+		Prefixes        []string `yaml:"prefixes"`
 	}
 }
 
@@ -49,17 +126,133 @@ func Build(file string) (*chat.Server, error) {
 		chat.WithName(config.General.Name),
 		chat.WithMOTD(config.General.MOTD),
 		chat.WithMainChannel(config.General.MainChannel),
-		chat.WithChannels(config.Channels...),
 		chat.WithTextLimit(config.General.CharacterLimit),
 		chat.WithTextInterval(time.Duration(config.General.MessageInterval)*time.Millisecond),
 	)
+	for _, channel := range config.Channels {
+		var options []chat.ChannelOption
+		if channel.Topic != "" {
+			options = append(options, chat.WithTopic(channel.Topic))
+		}
+		if channel.Welcome != "" {
+			options = append(options, chat.WithWelcome(channel.Welcome))
+		}
+		permissions, err := buildPermissions(channel)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, chat.WithPermissions(permissions))
+		chat.WithChannel(channel.Name, options...)(server)
+	}
+	if config.General.OutboxSize != nil {
+		chat.WithOutboxSize(*config.General.OutboxSize)(server)
+	}
+	if config.General.SendQueue > 0 {
+		chat.WithSendQueue(config.General.SendQueue)(server)
+	}
+	switch config.General.Backpressure {
+	case "", "dropOldest":
+	case "dropLowPriority":
+		chat.WithBackpressure(chat.DropLowPriority)(server)
+	case "disconnect":
+		chat.WithBackpressure(chat.Disconnect)(server)
+	default:
+		return nil, errors.Errorf("unknown backpressure policy %s", config.General.Backpressure)
+	}
+	if config.ChannelPolicy != nil {
+		policy, err := buildChannelPolicy(config.ChannelPolicy)
+		if err != nil {
+			return nil, err
+		}
+		chat.WithChannelPolicy(policy)(server)
+	}
+	if config.NamePolicy != nil {
+		policy, err := buildNamePolicy(config.NamePolicy)
+		if err != nil {
+			return nil, err
+		}
+		chat.WithNamePolicy(policy)(server)
+	}
+	if config.Auth.Secret != "" {
+		chat.WithAuthenticator(auth.NewTokenAuthenticator([]byte(config.Auth.Secret)))(server)
+	}
+	if config.Auth.Htpasswd != "" {
+		passwords, err := auth.LoadPasswords(config.Auth.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		chat.WithAuthenticator(passwords)(server)
+	}
+	if config.Auth.SessionSecret != "" {
+		chat.WithSessionSecret([]byte(config.Auth.SessionSecret))(server)
+	}
+	if config.General.GracePeriod != nil {
+		chat.WithGracePeriod(time.Duration(*config.General.GracePeriod) * time.Second)(server)
+	}
+	if config.General.ReplaySize > 0 {
+		chat.WithReplaySize(config.General.ReplaySize)(server)
+	}
+	if config.General.ReplayRetention > 0 {
+		chat.WithReplayRetention(time.Duration(config.General.ReplayRetention) * time.Second)(server)
+	}
+	for _, prefix := range config.General.Prefixes {
+		if prefix == "" || strings.IndexFunc(prefix, unicode.IsSpace) >= 0 {
+			return nil, errors.Errorf("invalid command prefix %q", prefix)
+		}
+	}
+	if len(config.General.Prefixes) > 0 {
+		chat.WithPrefixes(config.General.Prefixes...)(server)
+	}
+	actionTimeout := chat.DefaultActionTimeout
+	if config.General.ActionTimeout > 0 {
+		actionTimeout = time.Duration(config.General.ActionTimeout) * time.Second
+		chat.WithActionTimeout(actionTimeout)(server)
+	}
+	if len(config.Roles) > 0 {
+		roles := map[string]chat.Role{}
+		for name, users := range config.Roles {
+			role, err := chat.ParseRole(name)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not read roles")
+			}
+			for _, user := range users {
+				roles[user] = role
+			}
+		}
+		chat.WithRoles(roles)(server)
+	}
+	if config.Auth.Guests != nil {
+		chat.WithGuests(*config.Auth.Guests)(server)
+	}
+	if err := checkAliases(server.ListActions(), config.Actions); err != nil {
+		return nil, err
+	}
 	for _, act := range config.Actions {
-		var generated chat.Handler
+		args, err := buildArgs(act.Args)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read arguments of action %s", act.Tag)
+		}
+		var generated chat.ContextHandler
 		switch act.Type {
 		case "private":
 			generated = blueprint.PrivateResponse(act.Sender, act.Channel, act.Data, act.Media)
 		case "broadcast":
 			generated = blueprint.BroadcastResponse(act.Data, act.Media)
+		case "template":
+			tmpl, err := blueprint.ParseTemplate(act.Tag, act.Data, args)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid template of action %s", act.Tag)
+			}
+			generated = blueprint.TemplateResponse(tmpl, act.Sender, act.Media, act.Broadcast)
+		case "webhook":
+			if target, err := url.Parse(act.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+				return nil, errors.Errorf("invalid webhook url of action %s", act.Tag)
+			}
+			timeout := time.Duration(act.Timeout) * time.Second
+			if timeout > actionTimeout {
+				return nil, errors.Errorf("timeout of action %s is longer than the action timeout of %v", act.Tag, actionTimeout)
+			}
+			generated = blueprint.WebhookResponse(act.URL, timeout, []byte(act.Secret), act.Sender)
 		default:
 			return nil, errors.Errorf("unknown action type %s", act.Type)
 		}
@@ -75,7 +268,150 @@ func Build(file string) (*chat.Server, error) {
 				return nil, errors.Errorf("unknown middleware type %s", name)
 			}
 		}
-		server.AddAction(chat.NewAction(act.Tag, act.Description, generated))
+		action := chat.Action{
+			Run:         generated,
+			Name:        act.Tag,
+			Description: act.Description,
+			Aliases:     act.Aliases,
+			Args:        args,
+			Group:       act.Group,
+			Hidden:      act.Hidden,
+		}
+		if act.Role != "" {
+			if action.Role, err = chat.ParseRole(act.Role); err != nil {
+				return nil, errors.Wrapf(err, "could not read role of action %s", act.Tag)
+			}
+		}
+		server.AddAction(action)
 	}
 	return server, nil
 }
+
+// checkAliases rejects aliases that are the name of an action or that are
+// used twice. Configured actions replace built-in actions of the same name.
+func checkAliases(builtin []chat.Action, config []Action) error {
+	names := map[string]bool{}
+	aliases := map[string]string{}
+	for _, act := range config {
+		names[act.Tag] = true
+	}
+	for _, action := range builtin {
+		if names[action.Name] {
+			continue
+		}
+		names[action.Name] = true
+		for _, alias := range action.Aliases {
+			aliases[alias] = action.Name
+		}
+	}
+	for _, act := range config {
+		for _, alias := range act.Aliases {
+			if names[alias] {
+				return errors.Errorf("alias %s of action %s is the name of an action", alias, act.Tag)
+			}
+			if other, ok := aliases[alias]; ok {
+				return errors.Errorf("alias %s of action %s is already used by action %s", alias, act.Tag, other)
+			}
+			aliases[alias] = act.Tag
+		}
+	}
+	return nil
+}
+
+func buildArgs(config []Arg) ([]chat.Arg, error) {
+	args := make([]chat.Arg, len(config))
+	for i, arg := range config {
+		kind, err := chat.ParseArgType(arg.Type)
+		if err != nil {
+			return nil, err
+		}
+		if kind == chat.ArgBool {
+			return nil, errors.Errorf("argument %s cannot be a bool", arg.Name)
+		}
+		if kind == chat.ArgText && i < len(config)-1 {
+			return nil, errors.Errorf("text argument %s must be the last one", arg.Name)
+		}
+		args[i] = chat.Arg{
+			Name:        arg.Name,
+			Type:        kind,
+			Description: arg.Description,
+			Optional:    arg.Optional,
+		}
+	}
+	return args, nil
+}
+
+func buildChannelPolicy(config *ChannelPolicy) (chat.ChannelPolicy, error) {
+	policy := chat.DefaultChannelPolicy
+	switch config.Create {
+	case "", "everyone":
+		policy.AllowCreate = true
+	case "nobody":
+		policy.AllowCreate = false
+	default:
+		role, err := chat.ParseRole(config.Create)
+		if err != nil {
+			return policy, errors.Errorf("unknown channel creation policy %s", config.Create)
+		}
+		policy.AllowCreate, policy.CreateRole = true, role
+	}
+	if config.NamePattern != "" {
+		pattern, err := regexp.Compile(config.NamePattern)
+		if err != nil {
+			return policy, errors.Wrap(err, "could not read channel name pattern")
+		}
+		policy.NamePattern = pattern
+	}
+	if config.MaxChannels > 0 {
+		policy.MaxChannels = config.MaxChannels
+	}
+	policy.TTL = time.Duration(config.TTL) * time.Second
+	return policy, nil
+}
+
+func buildNamePolicy(config *NamePolicy) (chat.NamePolicy, error) {
+	policy := chat.DefaultNamePolicy
+	if config.MinLength > 0 {
+		policy.MinLength = config.MinLength
+	}
+	if config.MaxLength > 0 {
+		policy.MaxLength = config.MaxLength
+	}
+	if config.Pattern != "" {
+		pattern, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return policy, errors.Wrap(err, "could not read name pattern")
+		}
+		policy.Pattern = pattern
+	}
+	policy.Reserved = config.Reserved
+	return policy, nil
+}
+
+// buildPermissions reads the roles of a channel. A locked topic can be
+// changed by moderators unless a topic role is given.
+func buildPermissions(channel Channel) (chat.Permissions, error) {
+	var permissions chat.Permissions
+	if channel.LockTopic {
+		permissions.Topic = chat.RoleModerator
+	}
+	for _, field := range []struct {
+		name string
+		role *chat.Role
+	}{
+		{channel.Read, &permissions.Read},
+		{channel.Write, &permissions.Write},
+		{channel.Join, &permissions.Join},
+		{channel.TopicRole, &permissions.Topic},
+	} {
+		if field.name == "" {
+			continue
+		}
+		role, err := chat.ParseRole(field.name)
+		if err != nil {
+			return permissions, errors.Wrapf(err, "could not read permissions of channel %s", channel.Name)
+		}
+		*field.role = role
+	}
+	return permissions, nil
+}
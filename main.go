@@ -30,11 +30,21 @@ func main() {
 		server = chat.New()
 		logrus.Info("Using default configuration")
 	}
-	if err := server.Connect(os.Getenv("RABBITMQ_URL")); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"url": os.Getenv("RABBITMQ_URL"),
-			"err": err,
-		}).Fatal("Could not connect to message broker")
+	var broker chat.Broker
+	if url := os.Getenv("RABBITMQ_URL"); url != "" {
+		broker, err = chat.DialAMQP(url)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"url": url,
+				"err": err,
+			}).Fatal("Could not connect to message broker")
+		}
+	} else {
+		broker = chat.NewMemoryBroker()
+		logrus.Info("Using in-memory message broker")
+	}
+	if err := server.Connect(broker); err != nil {
+		logrus.WithField("err", err).Fatal("Could not connect to message broker")
 	}
 	http.Handle("/", http.FileServer(http.Dir("static")))
 	http.Handle("/chat/", server.Handler())
@@ -3,18 +3,75 @@ if (location.protocol === "https:") {
     protocol = "wss://"
 }
 var server = protocol + location.host + "/chat/";
+var token = new URLSearchParams(location.search).get("token");
+if (token) {
+    server += "?token=" + encodeURIComponent(token);
+}
 var socket = null;
+var frameCounter = 0;
+var lastSeen = "";
+var prefixes = ["!"];
 window.onload = function () {
-    socket = new WebSocket(server);
+    connect();
+}
+
+function connect() {
+    var url = server;
+    if (lastSeen) {
+        url += (url.indexOf("?") < 0 ? "?" : "&") + "last=" + encodeURIComponent(lastSeen);
+    }
+    socket = new WebSocket(url, "webchat.v1");
     socket.onopen = function () {
         console.log("connected to " + server);
     }
     socket.onclose = function (e) {
-        console.log("connection closed (" + e.code + ")");
+        console.log("connection closed (" + e.code + "), reconnecting");
+        window.setTimeout(connect, 1000);
     }
     socket.onmessage = function (event) {
-        app.addMessage(JSON.parse(event.data));
+        var frame = JSON.parse(event.data);
+        switch (frame.type) {
+            case "hello":
+                if (frame.prefixes) {
+                    prefixes = frame.prefixes;
+                }
+                break;
+            case "message":
+                if (frame.message.id) {
+                    lastSeen = frame.message.id;
+                }
+                if (!frame.message.kind) {
+                    app.addMessage(frame.message);
+                }
+                break;
+            case "error":
+                app.addMessage({
+                    sender: "WebChat",
+                    data: frame.data || frame.error,
+                    priority: "muted",
+                });
+                break;
+        }
+    }
+}
+
+function sendFrame(frame) {
+    frame.v = 1;
+    frame.id = String(++frameCounter);
+    socket.send(JSON.stringify(frame));
+}
+
+function commandPrefix(msg) {
+    var longest = "";
+    prefixes.forEach(function (prefix) {
+        if (msg.indexOf(prefix) === 0 && prefix.length > longest.length) {
+            longest = prefix;
+        }
+    });
+    if (msg.length === longest.length || msg.charAt(longest.length) === " ") {
+        return "";
     }
+    return longest;
 }
 
 function send() {
@@ -23,7 +80,20 @@ function send() {
     if (msg === "") return false;
     input.value = '';
     input.focus();
-    socket.send(msg);
+    var prefix = commandPrefix(msg);
+    if (prefix) {
+        var parts = msg.substring(prefix.length).split(" ");
+        sendFrame({
+            type: "command",
+            name: parts[0],
+            args: parts.slice(1).join(" "),
+        });
+    } else {
+        sendFrame({
+            type: "message",
+            data: msg,
+        });
+    }
     return false;
 }
 
@@ -45,4 +115,4 @@ var app = new Vue({
             container.scrollTop = container.scrollHeight;
         },
     },
-});
\ No newline at end of file
+});